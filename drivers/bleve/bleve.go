@@ -0,0 +1,605 @@
+// Package bleve contains a search engine driver for Gocrud, backed by an
+// on-disk bleve index. It provides analyzed full text matching within a
+// single process, without running a search cluster.
+//
+// import _ "github.com/manishrjain/gocrud/drivers/bleve"
+// Initialize in main():
+// search.Get().Init("/tmp/bleve_dirname")
+package bleve
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/manishrjain/gocrud/search"
+	"github.com/manishrjain/gocrud/x"
+)
+
+var log = x.Log("bleve")
+
+// ErrVersionConflict is returned by Update, if the index already has the
+// same or a newer version of the doc.
+var ErrVersionConflict = errors.New("Newer version of doc already indexed")
+
+// kindField holds the doc kind, indexed without analysis, so queries can
+// be restricted to a kind via an exact term match. Similarly, fieldsField
+// holds the names of the top level fields with non-null values, for
+// AddExists and AddMissing.
+const (
+	kindField   = "gocrud_kind"
+	fieldsField = "gocrud_fields"
+)
+
+// Bleve encapsulates a bleve index, and implements methods declared
+// by search.Engine. The docs are indexed as per their Data fields, and also
+// stored as is within the index, to be returned back by queries.
+type Bleve struct {
+	sync.Mutex // Guards doc versions against concurrent updates.
+	index      bleve.Index
+}
+
+// BleveQuery implements methods declared by search.Query.
+type BleveQuery struct {
+	index  bleve.Index
+	kind   string
+	filter *BleveFilter
+	from   int
+	limit  int
+	order  []string
+	after  string
+}
+
+// Operators to combine the queries within a BleveFilter.
+const (
+	andOp = iota + 1
+	orOp
+	notOp // Negated AND.
+)
+
+type BleveFilter struct {
+	queries []query.Query
+	subs    []*BleveFilter // Nested clauses.
+	op      int
+}
+
+// Init opens the bleve index at the given path, creating it if missing.
+func (bl *Bleve) Init(args ...string) {
+	if len(args) != 1 {
+		log.WithField("args", args).Fatal("Invalid arguments")
+		return
+	}
+	path := args[0]
+
+	index, err := bleve.Open(path)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		kfm := bleve.NewTextFieldMapping()
+		kfm.Analyzer = keyword.Name
+		mapping := bleve.NewIndexMapping()
+		mapping.DefaultMapping.AddFieldMappingsAt(kindField, kfm)
+		mapping.DefaultMapping.AddFieldMappingsAt(fieldsField, kfm)
+		index, err = bleve.New(path, mapping)
+	}
+	if err != nil {
+		x.LogErr(log, err).Fatal("While opening bleve index")
+		return
+	}
+	bl.index = index
+	log.Debug("Opened bleve index")
+}
+
+// Close closes the underlying index.
+func (bl *Bleve) Close() error {
+	return bl.index.Close()
+}
+
+func docKey(kind, id string) string {
+	return kind + ":" + id
+}
+
+// Update indexes the doc, unless the index already has the same or a newer
+// version of it, as per doc.NanoTs. In which case, ErrVersionConflict is
+// returned.
+func (bl *Bleve) Update(doc x.Doc) error {
+	if doc.Id == "" || doc.Kind == "" || doc.NanoTs == 0 {
+		return errors.New("Invalid document")
+	}
+
+	source, err := json.Marshal(doc)
+	if err != nil {
+		x.LogErr(log, err).Error("While marshaling doc")
+		return err
+	}
+	// Round trip the data via JSON, so it gets indexed the same way,
+	// irrespective of whether it's a map, or a struct.
+	fields := make(map[string]interface{})
+	if doc.Data != nil {
+		buf, err := json.Marshal(doc.Data)
+		if err != nil {
+			x.LogErr(log, err).Error("While marshaling doc data")
+			return err
+		}
+		if err := json.Unmarshal(buf, &fields); err != nil {
+			x.LogErr(log, err).Error("Doc data should be a map or a struct")
+			return err
+		}
+	}
+	var names []string
+	for name, val := range fields {
+		if val != nil {
+			names = append(names, name)
+		}
+	}
+	fields[kindField] = doc.Kind
+	fields[fieldsField] = names
+
+	key := docKey(doc.Kind, doc.Id)
+	bl.Lock()
+	defer bl.Unlock()
+
+	if err := bl.checkVersion(key, doc.NanoTs); err != nil {
+		return err
+	}
+	b := bl.index.NewBatch()
+	if err := b.Index(key, fields); err != nil {
+		x.LogErr(log, err).WithField("doc", doc).Error("While indexing doc")
+		return err
+	}
+	b.SetInternal([]byte(key), source)
+	if err := bl.index.Batch(b); err != nil {
+		x.LogErr(log, err).WithField("doc", doc).Error("While indexing doc")
+		return err
+	}
+	return nil
+}
+
+// checkVersion returns ErrVersionConflict, if the index already has the
+// same or a newer version of the doc stored under key. Deleted docs retain
+// their versions as well.
+func (bl *Bleve) checkVersion(key string, nanoTs int64) error {
+	prev, err := bl.index.GetInternal([]byte(key))
+	if err != nil {
+		x.LogErr(log, err).Error("While retrieving doc")
+		return err
+	}
+	if prev == nil {
+		return nil
+	}
+	var pdoc x.Doc
+	if err := json.Unmarshal(prev, &pdoc); err != nil {
+		x.LogErr(log, err).Error("While unmarshaling doc")
+		return err
+	}
+	if pdoc.NanoTs >= nanoTs {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// Delete removes the doc from the index, but keeps a tombstone with its
+// version, so older versions of the doc can't be indexed again. Returns
+// ErrVersionConflict, if the index already has the same or a newer version.
+func (bl *Bleve) Delete(kind, id string, nanoTs int64) error {
+	if id == "" || kind == "" || nanoTs == 0 {
+		return errors.New("Invalid document")
+	}
+	source, err := json.Marshal(x.Doc{Kind: kind, Id: id, NanoTs: nanoTs,
+		Deleted: true})
+	if err != nil {
+		x.LogErr(log, err).Error("While marshaling doc")
+		return err
+	}
+
+	key := docKey(kind, id)
+	bl.Lock()
+	defer bl.Unlock()
+
+	if err := bl.checkVersion(key, nanoTs); err != nil {
+		return err
+	}
+	b := bl.index.NewBatch()
+	b.Delete(key)
+	b.SetInternal([]byte(key), source)
+	if err := bl.index.Batch(b); err != nil {
+		x.LogErr(log, err).WithField("key", key).Error("While deleting doc")
+		return err
+	}
+	return nil
+}
+
+// NewQuery creates a new query object, to return results of type kind.
+func (bl *Bleve) NewQuery(kind string) search.Query {
+	bq := new(BleveQuery)
+	bq.index = bl.index
+	bq.kind = kind
+	return bq
+}
+
+func (bq *BleveQuery) NewAndFilter() search.FilterQuery {
+	bq.filter = &BleveFilter{op: andOp}
+	return bq.filter
+}
+
+func (bq *BleveQuery) NewOrFilter() search.FilterQuery {
+	bq.filter = &BleveFilter{op: orOp}
+	return bq.filter
+}
+
+func (bf *BleveFilter) sub(op int) search.FilterQuery {
+	sub := &BleveFilter{op: op}
+	bf.subs = append(bf.subs, sub)
+	return sub
+}
+
+func (bf *BleveFilter) And() search.FilterQuery {
+	return bf.sub(andOp)
+}
+
+func (bf *BleveFilter) Or() search.FilterQuery {
+	return bf.sub(orOp)
+}
+
+func (bf *BleveFilter) Not() search.FilterQuery {
+	return bf.sub(notOp)
+}
+
+// build translates the filter tree into nested conjunction, disjunction
+// and boolean queries. Returns nil if there are no queries within the tree.
+func (bf *BleveFilter) build() (query.Query, error) {
+	queries := append([]query.Query{}, bf.queries...)
+	for _, sub := range bf.subs {
+		q, err := sub.build()
+		if err != nil {
+			return nil, err
+		}
+		if q != nil {
+			queries = append(queries, q)
+		}
+	}
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	switch bf.op {
+	case andOp:
+		return bleve.NewConjunctionQuery(queries...), nil
+	case orOp:
+		return bleve.NewDisjunctionQuery(queries...), nil
+	case notOp:
+		q := bleve.NewBooleanQuery()
+		q.AddMustNot(bleve.NewConjunctionQuery(queries...))
+		return q, nil
+	}
+	return nil, errors.New("Invalid filter type")
+}
+
+// fieldName strips the optional "data." prefix, because docs are indexed
+// by their Data fields.
+func fieldName(field string) string {
+	if len(field) > len("data.") && strings.ToLower(field[0:5]) == "data." {
+		return field[5:]
+	}
+	return field
+}
+
+// AddExact uses a term query for strings, so just like with ElasticSearch,
+// it matches individual terms generated by the analyzer; not the full
+// string. Numbers and booleans are matched exactly.
+func (bf *BleveFilter) AddExact(field string,
+	value interface{}) search.FilterQuery {
+
+	field = fieldName(field)
+	var q query.FieldableQuery
+	switch v := value.(type) {
+	case bool:
+		q = bleve.NewBoolFieldQuery(v)
+	case string:
+		q = bleve.NewTermQuery(v)
+	default:
+		if f, ok := search.ToFloat(value); ok {
+			inclusive := true
+			q = bleve.NewNumericRangeInclusiveQuery(&f, &f, &inclusive, &inclusive)
+		} else {
+			q = bleve.NewTermQuery(fmt.Sprintf("%v", value))
+		}
+	}
+	q.SetField(field)
+	bf.queries = append(bf.queries, q)
+	return bf
+}
+
+// AddRegex matches the regular expression against the terms generated by
+// the analyzer.
+func (bf *BleveFilter) AddRegex(field string,
+	value string) search.FilterQuery {
+
+	q := bleve.NewRegexpQuery(value)
+	q.SetField(fieldName(field))
+	bf.queries = append(bf.queries, q)
+	return bf
+}
+
+// AddRange picks a numeric, date or term range query, as per the type of
+// the bounds. Note that time.Time values get indexed as dates, and strings
+// as analyzed terms.
+func (bf *BleveFilter) AddRange(field string,
+	gte, lte interface{}) search.FilterQuery {
+
+	field = fieldName(field)
+	bound := gte
+	if bound == nil {
+		bound = lte
+	}
+
+	inclusive := true
+	var q query.FieldableQuery
+	switch bound.(type) {
+	case nil:
+		return bf.AddExists(field)
+	case string:
+		min, _ := gte.(string)
+		max, _ := lte.(string)
+		q = bleve.NewTermRangeInclusiveQuery(min, max, &inclusive, &inclusive)
+	case time.Time:
+		start, _ := gte.(time.Time)
+		end, _ := lte.(time.Time)
+		q = bleve.NewDateRangeInclusiveQuery(start, end, &inclusive, &inclusive)
+	default:
+		var min, max *float64
+		if f, ok := search.ToFloat(gte); ok {
+			min = &f
+		}
+		if f, ok := search.ToFloat(lte); ok {
+			max = &f
+		}
+		q = bleve.NewNumericRangeInclusiveQuery(min, max, &inclusive, &inclusive)
+	}
+	q.SetField(field)
+	bf.queries = append(bf.queries, q)
+	return bf
+}
+
+// AddPrefix matches the prefix against the terms generated by the analyzer.
+func (bf *BleveFilter) AddPrefix(field string,
+	prefix string) search.FilterQuery {
+
+	q := bleve.NewPrefixQuery(prefix)
+	q.SetField(fieldName(field))
+	bf.queries = append(bf.queries, q)
+	return bf
+}
+
+// AddMatch does analyzed full text matching. The text is run through the
+// same analyzer as the field, and docs with any of the resulting terms
+// match.
+func (bf *BleveFilter) AddMatch(field string,
+	text string) search.FilterQuery {
+
+	q := bleve.NewMatchQuery(text)
+	q.SetField(fieldName(field))
+	bf.queries = append(bf.queries, q)
+	return bf
+}
+
+// AddExists only works for top level fields.
+func (bf *BleveFilter) AddExists(field string) search.FilterQuery {
+	q := bleve.NewTermQuery(fieldName(field))
+	q.SetField(fieldsField)
+	bf.queries = append(bf.queries, q)
+	return bf
+}
+
+// AddMissing only works for top level fields.
+func (bf *BleveFilter) AddMissing(field string) search.FilterQuery {
+	tq := bleve.NewTermQuery(fieldName(field))
+	tq.SetField(fieldsField)
+	q := bleve.NewBooleanQuery()
+	q.AddMustNot(tq)
+	bf.queries = append(bf.queries, q)
+	return bf
+}
+
+// From sets the offset.
+func (bq *BleveQuery) From(num int) search.Query {
+	bq.from = num
+	return bq
+}
+
+// Limit limits the number of results to num.
+func (bq *BleveQuery) Limit(num int) search.Query {
+	bq.limit = num
+	return bq
+}
+
+// Order sorts the results by the given fields. Note that analyzed string
+// fields get sorted by their terms, not by the full string. Bleve places
+// docs missing a field last, by default.
+func (bq *BleveQuery) Order(fields ...string) search.Query {
+	bq.order = fields
+	return bq
+}
+
+func (bq *BleveQuery) generateQuery() (query.Query, error) {
+	kq := bleve.NewTermQuery(bq.kind)
+	kq.SetField(kindField)
+	if bq.filter == nil {
+		return kq, nil
+	}
+
+	fq, err := bq.filter.build()
+	if err != nil || fq == nil {
+		return kq, err
+	}
+	return bleve.NewConjunctionQuery(kq, fq), nil
+}
+
+// After continues from the doc the cursor points to, via search after.
+func (bq *BleveQuery) After(cursor string) search.Query {
+	bq.after = cursor
+	return bq
+}
+
+// sortOrder returns the fields to sort by. Docs with the same values for
+// all the order fields are sorted by their keys, which for a single kind
+// is the same as sorting them by their ids.
+func (bq *BleveQuery) sortOrder() []string {
+	var order []string
+	for _, field := range bq.order {
+		if strings.HasPrefix(field, "-") {
+			order = append(order, "-"+fieldName(field[1:]))
+		} else {
+			order = append(order, fieldName(field))
+		}
+	}
+	return append(order, "_id")
+}
+
+// encodeCursor stores the sort values of a hit as bytes, because bleve
+// encodes numbers, and missing values, in terms which aren't valid UTF-8.
+func encodeCursor(vals []string) (string, error) {
+	key := make([]interface{}, len(vals))
+	for i, v := range vals {
+		key[i] = []byte(v)
+	}
+	return search.EncodeCursor(key)
+}
+
+func (bq *BleveQuery) decodeCursor(cursor string) ([]string, error) {
+	key, err := search.DecodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != len(bq.sortOrder()) {
+		return nil, search.ErrInvalidCursor
+	}
+	vals := make([]string, len(key))
+	for i, k := range key {
+		s, ok := k.(string)
+		if !ok {
+			return nil, search.ErrInvalidCursor
+		}
+		buf, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, search.ErrInvalidCursor
+		}
+		vals[i] = string(buf)
+	}
+	return vals, nil
+}
+
+// run runs the query, and returns the sort values of the last hit.
+func (bq *BleveQuery) run(sorted bool) (docs []x.Doc, last []string, rerr error) {
+	q, err := bq.generateQuery()
+	if err != nil {
+		return docs, last, err
+	}
+
+	size := bq.limit
+	if size <= 0 {
+		count, err := bq.index.DocCount()
+		if err != nil {
+			x.LogErr(log, err).Error("While counting docs")
+			return docs, last, err
+		}
+		size = int(count)
+	}
+	// Search after can't be combined with an offset, so the docs to skip
+	// are retrieved, and dropped below.
+	from, skip := bq.from, 0
+	if len(bq.after) > 0 && from > 0 {
+		from, skip = 0, from
+		size += skip
+	}
+	sr := bleve.NewSearchRequestOptions(q, size, from, false)
+	if len(bq.order) > 0 || len(bq.after) > 0 || sorted {
+		sr.SortBy(bq.sortOrder())
+	}
+	if len(bq.after) > 0 {
+		if sr.SearchAfter, err = bq.decodeCursor(bq.after); err != nil {
+			return docs, last, err
+		}
+	}
+
+	result, err := bq.index.Search(sr)
+	if err != nil {
+		x.LogErr(log, err).Error("While running query")
+		return docs, last, err
+	}
+	for idx, hit := range result.Hits {
+		if idx < skip {
+			continue
+		}
+		source, err := bq.index.GetInternal([]byte(hit.ID))
+		if err != nil {
+			x.LogErr(log, err).Error("While retrieving doc")
+			return docs, last, err
+		}
+		var d x.Doc
+		if err := json.Unmarshal(source, &d); err != nil {
+			x.LogErr(log, err).Error("While unmarshaling doc")
+			return docs, last, err
+		}
+		docs = append(docs, d)
+		last = hit.Sort
+	}
+	return docs, last, nil
+}
+
+// Run runs the query and returns results and error, if any.
+func (bq *BleveQuery) Run() (docs []x.Doc, rerr error) {
+	docs, _, err := bq.run(false)
+	return docs, err
+}
+
+// RunWithCursor runs the query sorted by the doc keys after the order
+// field, and returns the cursor to the last doc.
+func (bq *BleveQuery) RunWithCursor() (docs []x.Doc, cursor string, rerr error) {
+	docs, last, err := bq.run(true)
+	if err != nil || len(docs) == 0 {
+		return docs, "", err
+	}
+	cursor, err = encodeCursor(last)
+	return docs, cursor, err
+}
+
+// Count the number of results that would be generated.
+func (bq *BleveQuery) Count() (rcount int64, rerr error) {
+	q, err := bq.generateQuery()
+	if err != nil {
+		return 0, err
+	}
+	result, err := bq.index.Search(bleve.NewSearchRequestOptions(q, 0, 0, false))
+	if err != nil {
+		x.LogErr(log, err).Error("While counting")
+		return 0, err
+	}
+	return int64(result.Total), nil
+}
+
+// Aggregate runs the query to retrieve all the matching docs, and computes
+// the aggregations over them in memory, via search.AggregateDocs.
+func (bq *BleveQuery) Aggregate(
+	aggs ...search.Aggregation) (map[string]search.AggResult, error) {
+
+	all := *bq
+	all.from, all.limit, all.order, all.after = 0, 0, nil, ""
+	docs, err := all.Run()
+	if err != nil {
+		return nil, err
+	}
+	return search.AggregateDocs(docs, aggs...)
+}
+
+func init() {
+	log.Info("Initing bleve")
+	if err := search.Register("bleve", new(Bleve)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
+}
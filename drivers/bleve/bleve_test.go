@@ -0,0 +1,124 @@
+package bleve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manishrjain/gocrud/testx"
+	"github.com/manishrjain/gocrud/x"
+)
+
+func initialize(t *testing.T) (*Bleve, string) {
+	dir, err := ioutil.TempDir("", "gocrudbleve_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := new(Bleve)
+	bl.Init(filepath.Join(dir, "index"))
+	testx.AddDocs(bl)
+	return bl, dir
+}
+
+func TestNewAndFilter(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunAndFilter(bl, t)
+}
+
+func TestNewOrFilter(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunOrFilter(bl, t)
+}
+
+func TestCount(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunCount(bl, t)
+}
+
+func TestFrom(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunFromLimit(bl, t)
+}
+
+func TestRangeFilter(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunRangeFilter(bl, t)
+}
+
+func TestPrefixFilter(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunPrefixFilter(bl, t)
+}
+
+func TestMatchFilter(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunMatchFilter(bl, t)
+}
+
+func TestExistsFilter(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunExistsFilter(bl, t)
+}
+
+func TestNestedFilter(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunNestedFilter(bl, t)
+}
+
+func TestAggregate(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunAggregate(bl, t)
+}
+
+func TestCursor(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunCursor(bl, t)
+}
+
+func TestMultiOrder(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunMultiOrder(bl, t)
+}
+
+func TestDelete(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunDelete(bl, t)
+}
+
+func TestVersions(t *testing.T) {
+	bl, dir := initialize(t)
+	defer os.RemoveAll(dir)
+
+	d := x.Doc{Kind: "Star", Id: "sun", NanoTs: 10,
+		Data: map[string]interface{}{"name": "sun"}}
+	if err := bl.Update(d); err != nil {
+		t.Fatalf("While updating: %v", err)
+	}
+	d.NanoTs = 5
+	d.Data = map[string]interface{}{"name": "old sun"}
+	if err := bl.Update(d); err != ErrVersionConflict {
+		t.Errorf("Expected ErrVersionConflict. Got: %v", err)
+	}
+
+	docs, err := bl.NewQuery("Star").Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+	}
+	if len(docs) != 1 || docs[0].NanoTs != 10 {
+		t.Errorf("Expected the newer doc only. Got: %+v", docs)
+	}
+}
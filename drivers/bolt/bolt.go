@@ -0,0 +1,209 @@
+// Package bolt contains a store driver for Gocrud, backed by bbolt; an
+// embedded key value store which needs no compaction, and works well with
+// single binary deployments.
+//
+// import _ "github.com/manishrjain/gocrud/drivers/bolt"
+// Initialize in main():
+// store.Get().Init("/tmp/bolt_filename")
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/manishrjain/gocrud/store"
+	"github.com/manishrjain/gocrud/x"
+	"go.etcd.io/bbolt"
+)
+
+var log = x.Log("bolt")
+
+// Buckets used by the driver. Instructions are keyed by the subject id
+// and a sequence number, so all the instructions for an entity can be
+// retrieved via a prefix scan. Entities maps subject ids to their types,
+// for IsNew and Iterate. Incoming does the same as instructions, but keyed
+// by object ids instead, for Query.Incoming.
+var (
+	bInstructions = []byte("instructions")
+	bEntities     = []byte("entities")
+	bIncoming     = []byte("incoming")
+)
+
+// sep separates the id from the sequence number in the keys. It sorts
+// before any character allowed in ids, so one id can't be mistaken as
+// a prefix of another.
+const sep = byte(0)
+
+type Bolt struct {
+	db *bbolt.DB
+}
+
+func (b *Bolt) Init(args ...string) {
+	if len(args) != 1 {
+		log.WithField("args", args).Fatal("Invalid arguments")
+		return
+	}
+	filepath := args[0]
+
+	var err error
+	b.db, err = bbolt.Open(filepath, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		x.LogErr(log, err).Fatal("While opening bolt db")
+		return
+	}
+
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{bInstructions, bEntities, bIncoming} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		x.LogErr(log, err).Fatal("While creating buckets")
+		return
+	}
+}
+
+// prefix returns the key prefix under which the rows for id are stored.
+func prefix(id string) []byte {
+	return append([]byte(id), sep)
+}
+
+// key generates a unique key for a row under id.
+func key(bucket *bbolt.Bucket, id string) ([]byte, error) {
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	k := prefix(id)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], seq)
+	return append(k, buf[:]...), nil
+}
+
+func (b *Bolt) IsNew(subject string) bool {
+	isnew := true
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		isnew = tx.Bucket(bEntities).Get([]byte(subject)) == nil
+		return nil
+	})
+	if err != nil {
+		x.LogErr(log, err).Error("While checking is new")
+		return false
+	}
+	return isnew
+}
+
+// Commit writes all the instructions within a single bolt transaction,
+// so they're applied atomically. Also, bolt only allows a single process
+// to open the database. So, conditional updates via Update.IfUnchangedSince
+// are fully guarded by the locking done within store.
+func (b *Bolt) Commit(its []*x.Instruction) error {
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		ib := tx.Bucket(bInstructions)
+		eb := tx.Bucket(bEntities)
+		rb := tx.Bucket(bIncoming)
+
+		for _, it := range its {
+			buf, err := it.GobEncode()
+			if err != nil {
+				return err
+			}
+			k, err := key(ib, it.SubjectId)
+			if err != nil {
+				return err
+			}
+			if err := ib.Put(k, buf); err != nil {
+				return err
+			}
+			if err := eb.Put([]byte(it.SubjectId), []byte(it.SubjectType)); err != nil {
+				return err
+			}
+			if len(it.ObjectId) == 0 {
+				continue
+			}
+			if k, err = key(rb, it.ObjectId); err != nil {
+				return err
+			}
+			if err := rb.Put(k, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		x.LogErr(log, err).Error("While writing to db")
+		return err
+	}
+	log.Debugf("%d instructions committed", len(its))
+	return nil
+}
+
+// scan decodes all the rows stored under id in the given bucket.
+func (b *Bolt) scan(bucket []byte, id string) (result []x.Instruction, rerr error) {
+	rerr = b.db.View(func(tx *bbolt.Tx) error {
+		p := prefix(id)
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			var i x.Instruction
+			if err := i.GobDecode(v); err != nil {
+				return err
+			}
+			result = append(result, i)
+		}
+		return nil
+	})
+	if rerr != nil {
+		x.LogErr(log, rerr).Error("While scanning")
+	}
+	return result, rerr
+}
+
+func (b *Bolt) GetEntity(id string) ([]x.Instruction, error) {
+	return b.scan(bInstructions, id)
+}
+
+// GetIncoming retrieves all the instructions with the given object id.
+func (b *Bolt) GetIncoming(id string) ([]x.Instruction, error) {
+	return b.scan(bIncoming, id)
+}
+
+// Iterate pages over the entities in the order of their ids, starting
+// right after fromId.
+func (b *Bolt) Iterate(fromId string, num int,
+	ch chan x.Entity) (found int, last x.Entity, rerr error) {
+
+	var entities []x.Entity
+	rerr = b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bEntities).Cursor()
+		for k, v := c.Seek([]byte(fromId)); k != nil && len(entities) < num; k, v = c.Next() {
+			if string(k) == fromId {
+				continue
+			}
+			entities = append(entities, x.Entity{Kind: string(v), Id: string(k)})
+		}
+		return nil
+	})
+	if rerr != nil {
+		x.LogErr(log, rerr).Error("While iterating")
+		return found, last, rerr
+	}
+
+	// Channel sends could block, so they're done outside the transaction.
+	for _, e := range entities {
+		ch <- e
+		last = e
+		found += 1
+	}
+	return found, last, nil
+}
+
+func init() {
+	log.Info("Initing bolt")
+	if err := store.Register("bolt", new(Bolt)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
+}
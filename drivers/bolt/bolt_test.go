@@ -0,0 +1,76 @@
+package bolt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/manishrjain/gocrud/testx"
+	"github.com/manishrjain/gocrud/x"
+)
+
+func initialize(t *testing.T) (*Bolt, string) {
+	dir, err := ioutil.TempDir("", "gocrudbolt_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := new(Bolt)
+	b.Init(filepath.Join(dir, "test.db"))
+	return b, dir
+}
+
+func TestCommit(t *testing.T) {
+	b, dir := initialize(t)
+	defer os.RemoveAll(dir)
+
+	if !b.IsNew("abc") {
+		t.Error("Expected abc to be new")
+	}
+	its := []*x.Instruction{
+		{SubjectId: "abc", SubjectType: "User", Predicate: "name", NanoTs: 1},
+		{SubjectId: "abc", SubjectType: "User", Predicate: "follows",
+			ObjectId: "abcd", NanoTs: 2},
+		{SubjectId: "abcd", SubjectType: "User", Predicate: "name", NanoTs: 3},
+	}
+	if err := b.Commit(its); err != nil {
+		t.Fatalf("While committing: %+v", err)
+	}
+	if b.IsNew("abc") || b.IsNew("abcd") {
+		t.Error("Expected abc and abcd to exist")
+	}
+	if !b.IsNew("ab") {
+		t.Error("Expected ab to be new")
+	}
+
+	// abc is a prefix of abcd, but their instructions shouldn't mix.
+	result, err := b.GetEntity("abc")
+	if err != nil {
+		t.Fatalf("While getting entity: %+v", err)
+	}
+	if len(result) != 2 {
+		t.Errorf("Expected 2 instructions. Got: %+v", result)
+	}
+	for _, i := range result {
+		if i.SubjectId != "abc" {
+			t.Errorf("Unexpected instruction: %+v", i)
+		}
+	}
+
+	incoming, err := b.GetIncoming("abcd")
+	if err != nil {
+		t.Fatalf("While getting incoming: %+v", err)
+	}
+	if len(incoming) != 1 || incoming[0].SubjectId != "abc" {
+		t.Errorf("Expected incoming edge from abc. Got: %+v", incoming)
+	}
+	if incoming, _ = b.GetIncoming("abc"); len(incoming) != 0 {
+		t.Errorf("Expected no incoming edges. Got: %+v", incoming)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	b, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunIterate(b, t)
+}
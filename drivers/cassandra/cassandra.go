@@ -7,7 +7,8 @@
 // Now copy the contents of table_cassandra.cql to clipboard.
 // $ docker run -it --rm --net container:cassone poklet/cassandra cqlsh
 // Paste the cql instructions. This would generate the 'instructions'
-// table in a 'crudtest' keyspace.
+// table in a 'crudtest' keyspace. Alternatively, call SetEnsureSchema(true)
+// before Init, to have the driver create the keyspace, table and indexes.
 //
 // Cassandra driver can now be imported, and initialized in social.go,
 // or any other client.
@@ -27,10 +28,13 @@ import (
 var log = x.Log("cassandra")
 
 type Cassandra struct {
-	session *gocql.Session
-}
+	session      *gocql.Session
+	table        string
+	ensureSchema bool
 
-var kIsNew, kInsert, kSelect, kScan string
+	// Queries generated by setTable, as per the table name.
+	kIsNew, kInsert, kSelect, kScan, kIncoming string
+}
 
 func (cs *Cassandra) SetSession(session *gocql.Session) {
 	cs.session = session
@@ -58,24 +62,45 @@ func (cs *Cassandra) Init(args ...string) {
 		}
 	}
 
+	if cs.ensureSchema {
+		if err := createKeyspace(cluster, keyspace); err != nil {
+			x.LogErr(log, err).Fatal("While creating keyspace")
+			return
+		}
+	}
+
 	session, err := cluster.CreateSession()
 	if err != nil {
 		x.LogErr(log, err).Fatal("While creating session")
 		return
 	}
 	cs.session = session
+	cs.setTable(tablename)
+
+	if cs.ensureSchema {
+		if err := cs.ensure(); err != nil {
+			x.LogErr(log, err).Fatal("While ensuring schema")
+			return
+		}
+	}
+}
 
-	kIsNew = fmt.Sprintf("select subject_id from %s where subject_id = ?", tablename)
-	kInsert = fmt.Sprintf(`insert into %s (ts, subject_id, subject_type, predicate,
+// setTable sets the table name, and generates the queries run against it.
+func (cs *Cassandra) setTable(tablename string) {
+	cs.table = tablename
+	cs.kIsNew = fmt.Sprintf("select subject_id from %s where subject_id = ?", tablename)
+	cs.kInsert = fmt.Sprintf(`insert into %s (ts, subject_id, subject_type, predicate,
 object, object_id, nano_ts, source) values (now(), ?, ?, ?, ?, ?, ?, ?)`, tablename)
-	kSelect = fmt.Sprintf(`select subject_id, subject_type, predicate, object,
+	cs.kSelect = fmt.Sprintf(`select subject_id, subject_type, predicate, object,
 object_id, nano_ts, source from %s where subject_id = ?`, tablename)
-	kScan = fmt.Sprintf(`select subject_type, subject_id
+	cs.kIncoming = fmt.Sprintf(`select subject_id, subject_type, predicate, object,
+object_id, nano_ts, source from %s where object_id = ?`, tablename)
+	cs.kScan = fmt.Sprintf(`select subject_type, subject_id
 from %s where token(subject_id) > token(?) limit ?`, tablename)
 }
 
 func (cs *Cassandra) IsNew(subject string) bool {
-	iter := cs.session.Query(kIsNew, subject).Iter()
+	iter := cs.session.Query(cs.kIsNew, subject).Iter()
 	var sid string
 	isnew := true
 	for iter.Scan(&sid) {
@@ -88,14 +113,19 @@ func (cs *Cassandra) IsNew(subject string) bool {
 	return isnew
 }
 
+// Commit writes all the instructions via a logged batch, which guarantees
+// that either all of them or none of them would eventually get applied.
+// Logged batches aren't isolated though. Conditional updates via
+// Update.IfUnchangedSince can race with writers from other processes.
 func (cs *Cassandra) Commit(its []*x.Instruction) error {
 	b := cs.session.NewBatch(gocql.LoggedBatch)
 	for _, it := range its {
-		b.Query(kInsert, it.SubjectId, it.SubjectType, it.Predicate,
+		b.Query(cs.kInsert, it.SubjectId, it.SubjectType, it.Predicate,
 			it.Object, it.ObjectId, it.NanoTs, it.Source)
 	}
 	if err := cs.session.ExecuteBatch(b); err != nil {
 		x.LogErr(log, err).Error("While executing batch")
+		return err
 	}
 	log.WithField("len", len(its)).Debug("Stored instructions")
 	return nil
@@ -103,7 +133,24 @@ func (cs *Cassandra) Commit(its []*x.Instruction) error {
 
 func (cs *Cassandra) GetEntity(subject string) (
 	result []x.Instruction, rerr error) {
-	iter := cs.session.Query(kSelect, subject).Iter()
+	iter := cs.session.Query(cs.kSelect, subject).Iter()
+	var i x.Instruction
+	for iter.Scan(&i.SubjectId, &i.SubjectType, &i.Predicate, &i.Object,
+		&i.ObjectId, &i.NanoTs, &i.Source) {
+		result = append(result, i)
+	}
+	if err := iter.Close(); err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		return result, err
+	}
+	return result, nil
+}
+
+// GetIncoming retrieves all the instructions with the given object id.
+// This requires a secondary index on object_id, see table_cassandra.cql.
+func (cs *Cassandra) GetIncoming(object string) (
+	result []x.Instruction, rerr error) {
+	iter := cs.session.Query(cs.kIncoming, object).Iter()
 	var i x.Instruction
 	for iter.Scan(&i.SubjectId, &i.SubjectType, &i.Predicate, &i.Object,
 		&i.ObjectId, &i.NanoTs, &i.Source) {
@@ -119,7 +166,7 @@ func (cs *Cassandra) GetEntity(subject string) (
 func (cs *Cassandra) Iterate(fromId string, num int,
 	ch chan x.Entity) (rnum int, rlast x.Entity, rerr error) {
 
-	iter := cs.session.Query(kScan, fromId, num).Iter()
+	iter := cs.session.Query(cs.kScan, fromId, num).Iter()
 	var e x.Entity
 	handled := make(map[x.Entity]bool)
 	rnum = 0
@@ -144,5 +191,7 @@ func (cs *Cassandra) Iterate(fromId string, num int,
 
 func init() {
 	log.Info("Initing cassandra")
-	store.Register("cassandra", new(Cassandra))
+	if err := store.Register("cassandra", new(Cassandra)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
 }
@@ -0,0 +1,27 @@
+package cassandra
+
+import (
+	"strings"
+	"testing"
+)
+
+// Each instance should query its own table, irrespective of the order in
+// which they're initialized.
+func TestTwoInstances(t *testing.T) {
+	posts := new(Cassandra)
+	posts.setTable("posts")
+	archive := new(Cassandra)
+	archive.setTable("archive")
+
+	for _, tc := range []struct {
+		cs    *Cassandra
+		table string
+	}{{posts, "posts"}, {archive, "archive"}} {
+		for _, q := range []string{tc.cs.kIsNew, tc.cs.kInsert, tc.cs.kSelect,
+			tc.cs.kScan, tc.cs.kIncoming} {
+			if !strings.Contains(q, " "+tc.table+" ") {
+				t.Errorf("Expected query on %v. Got: %v", tc.table, q)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package cassandra
+
+import (
+	"fmt"
+
+	"github.com/gocql/gocql"
+	"github.com/manishrjain/gocrud/store"
+)
+
+// SetEnsureSchema, if called with true before Init, makes Init create the
+// keyspace, the instructions table and its indexes, if they don't already
+// exist, and apply any pending schema migrations. The schema version is
+// tracked in a separate table, named after the instructions table with a
+// _schema suffix. Note that the keyspace gets created with SimpleStrategy,
+// and a replication factor of 1; create it manually for anything else.
+func (cs *Cassandra) SetEnsureSchema(ensure bool) {
+	cs.ensureSchema = ensure
+}
+
+// createKeyspace connects to the cluster without a keyspace, because it
+// might not exist yet, and creates the keyspace.
+func createKeyspace(cluster *gocql.ClusterConfig, keyspace string) error {
+	c := *cluster
+	c.Keyspace = ""
+	session, err := c.CreateSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return session.Query(fmt.Sprintf(`create keyspace if not exists %s
+with replication = {'class': 'SimpleStrategy', 'replication_factor': 1}
+and durable_writes = true`, keyspace)).Exec()
+}
+
+// migrations lists the schema changes for the instructions table, in order.
+// Append to this list, to change the schema.
+func (cs *Cassandra) migrations() []store.Migration {
+	return []store.Migration{
+		{Version: 1, Apply: cs.createTable},
+		{Version: 2, Apply: cs.createIndexes},
+	}
+}
+
+func (cs *Cassandra) createTable() error {
+	return cs.session.Query(fmt.Sprintf(`create table if not exists %s (
+	subject_id text,
+	ts timeuuid,
+	subject_type text,
+	predicate text,
+	object blob,
+	object_id text,
+	nano_ts bigint,
+	source text,
+	PRIMARY KEY (subject_id, ts)
+	) with compaction = {'class': 'LeveledCompactionStrategy'}`, cs.table)).Exec()
+}
+
+// createIndexes adds secondary indexes. subject_id is the partition key,
+// so it doesn't need one.
+func (cs *Cassandra) createIndexes() error {
+	for _, col := range []string{"object_id", "nano_ts"} {
+		q := fmt.Sprintf("create index if not exists on %s (%s)", cs.table, col)
+		if err := cs.session.Query(q).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensure creates the schema version table if needed, and brings the
+// instructions table up to the latest schema version.
+func (cs *Cassandra) ensure() error {
+	vtable := cs.table + "_schema"
+	if err := cs.session.Query(fmt.Sprintf(`create table if not exists %s (
+	id text PRIMARY KEY,
+	version int
+	)`, vtable)).Exec(); err != nil {
+		return err
+	}
+
+	var current int
+	err := cs.session.Query(fmt.Sprintf(
+		"select version from %s where id = 'schema'", vtable)).Scan(&current)
+	if err != nil && err != gocql.ErrNotFound {
+		return err
+	}
+
+	insert := fmt.Sprintf(
+		"insert into %s (id, version) values ('schema', ?)", vtable)
+	version, err := store.RunMigrations(current, cs.migrations(),
+		func(v int) error {
+			return cs.session.Query(insert, v).Exec()
+		})
+	if err != nil {
+		return err
+	}
+	log.WithField("version", version).Debug("Schema is up to date")
+	return nil
+}
@@ -46,6 +46,9 @@ func (ds *Datastore) getIKey(i x.Instruction) *datastore.Key {
 	return datastore.NewIncompleteKey(ds.ctx, ds.tablePrefix+"Instruction", skey)
 }
 
+// Commit puts all the instructions via PutMulti, outside of any datastore
+// transaction. So, Update.IfUnchangedSince doesn't detect conflicting
+// writes done by other processes in between the check and the commit.
 func (ds *Datastore) Commit(its []*x.Instruction) error {
 	var keys []*datastore.Key
 	for _, i := range its {
@@ -103,11 +106,12 @@ func (ds *Datastore) GetEntity(subject string) (reply []x.Instruction, rerr erro
 }
 
 func (ds *Datastore) Iterate(fromId string, num int, ch chan x.Entity) (found int, last x.Entity, err error) {
-	log.Fatal("Not implemented")
-	return
+	return 0, last, store.ErrNotImplemented
 }
 
 func init() {
 	log.Info("Initing datastore")
-	store.Register("datastore", new(Datastore))
+	if err := store.Register("datastore", new(Datastore)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
 }
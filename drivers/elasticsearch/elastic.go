@@ -2,7 +2,12 @@ package elasticsearch
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/manishrjain/gocrud/search"
 	"github.com/manishrjain/gocrud/x"
@@ -11,6 +16,13 @@ import (
 
 var log = x.Log("elasticsearch")
 
+// ErrCursorField is returned when running a query via cursor, if it's
+// ordered by a string field not declared as search.KeywordField or
+// search.DateField. Analyzed strings are sorted and matched by their
+// terms, so the docs after the cursor can't be found reliably.
+var ErrCursorField = errors.New(
+	"Cursors need string order fields mapped as keyword or date")
+
 // Elastic encapsulates elastic search client, and implements methods declared
 // by search.Engine.
 type Elastic struct {
@@ -19,23 +31,34 @@ type Elastic struct {
 
 // ElasticQuery implements methods declared by search.Query.
 type ElasticQuery struct {
-	client     *elastic.Client
-	sort       string
-	from       int
-	limit      int
-	kind       string
-	filter     *ElasticFilter
-	filterType int // 0 = no filter, 1 = AND, 2 = OR
+	client *elastic.Client
+	sort   []string
+	from   int
+	limit  int
+	kind   string
+	filter *ElasticFilter
+	after  string
 }
 
+// Operators to combine the filters within an ElasticFilter.
+const (
+	andOp = iota + 1
+	orOp
+	notOp // Negated AND.
+)
+
 type ElasticFilter struct {
 	filters []elastic.Filter
+	subs    []*ElasticFilter // Nested clauses.
+	op      int
 }
 
 // Init initializes connection to Elastic Search instance, checks for
-// existence of "gocrud" index and creates it, if missing. Note that
-// Init does NOT do mapping necessary to do exact-value term matching
-// for strings etc. That needs to be done externally.
+// existence of "gocrud" index and creates it, if missing. If any mappings
+// were declared via search.SetMapping, "gocrud" is instead created as an
+// alias to an index with those mappings, and switched to a new index,
+// whenever the mappings change. Strings need to be declared as
+// search.KeywordField for exact-value term matching.
 func (es *Elastic) Init(args ...string) {
 	if len(args) != 1 {
 		log.WithField("args", args).Fatal("Invalid arguments")
@@ -58,6 +81,16 @@ func (es *Elastic) Init(args ...string) {
 		return
 	}
 	log.WithField("version", version).Debug("ElasticSearch version")
+	es.client = client
+
+	if mappings := search.Mappings(); len(mappings) > 0 {
+		if err := es.applyMappings(mappings); err != nil {
+			x.LogErr(log, err).Fatal("While applying mappings")
+			return
+		}
+		log.Debug("Connected with ElasticSearch")
+		return
+	}
 
 	// Use the IndexExists service to check if a specified index exists.
 	exists, err := client.IndexExists("gocrud").Do()
@@ -77,11 +110,11 @@ func (es *Elastic) Init(args ...string) {
 			log.Errorf("Create index not acknowledged. Not sure what that means...")
 		}
 	}
-	es.client = client
 	log.Debug("Connected with ElasticSearch")
 }
 
-// DropIndex is useful for testing purposes.
+// DropIndex is useful for testing purposes. If "gocrud" is an alias, this
+// drops the index it points to.
 func (es *Elastic) DropIndex() error {
 	_, err := es.client.DeleteIndex("gocrud").Do()
 	return err
@@ -104,20 +137,86 @@ func (es *Elastic) Update(doc x.Doc) error {
 	return nil
 }
 
-func (eq *ElasticQuery) NewAndFilter() search.FilterQuery {
-	eq.filter = new(ElasticFilter)
-	eq.filterType = 1
+// Delete removes the doc with external versioning, so ElasticSearch rejects
+// older versions of the doc, at least until it garbage collects the deleted
+// version, as per index.gc_deletes.
+func (es *Elastic) Delete(kind, id string, nanoTs int64) error {
+	if id == "" || kind == "" || nanoTs == 0 {
+		return errors.New("Invalid document")
+	}
+
+	path := fmt.Sprintf("/gocrud/%s/%s", url.PathEscape(kind), url.PathEscape(id))
+	params := make(url.Values)
+	params.Set("version", fmt.Sprintf("%d", nanoTs))
+	params.Set("version_type", "external")
+	_, err := es.client.PerformRequest("DELETE", path, params, nil)
+	if e, ok := err.(*elastic.Error); ok && e.Status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		x.LogErr(log, err).WithField("id", id).Error("While deleting doc")
+		return err
+	}
+	return nil
+}
 
+func (eq *ElasticQuery) NewAndFilter() search.FilterQuery {
+	eq.filter = &ElasticFilter{op: andOp}
 	return eq.filter
 }
 
 func (eq *ElasticQuery) NewOrFilter() search.FilterQuery {
-	eq.filter = new(ElasticFilter)
-	eq.filterType = 2
-
+	eq.filter = &ElasticFilter{op: orOp}
 	return eq.filter
 }
 
+func (ef *ElasticFilter) sub(op int) search.FilterQuery {
+	sub := &ElasticFilter{op: op}
+	ef.subs = append(ef.subs, sub)
+	return sub
+}
+
+func (ef *ElasticFilter) And() search.FilterQuery {
+	return ef.sub(andOp)
+}
+
+func (ef *ElasticFilter) Or() search.FilterQuery {
+	return ef.sub(orOp)
+}
+
+func (ef *ElasticFilter) Not() search.FilterQuery {
+	return ef.sub(notOp)
+}
+
+// build translates the filter tree into nested bool filters. Returns nil
+// if there are no filters within the tree.
+func (ef *ElasticFilter) build() (elastic.Filter, error) {
+	filters := append([]elastic.Filter{}, ef.filters...)
+	for _, sub := range ef.subs {
+		f, err := sub.build()
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			filters = append(filters, f)
+		}
+	}
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	switch ef.op {
+	case andOp:
+		return elastic.NewBoolFilter().Must(filters...), nil
+	case orOp:
+		return elastic.NewBoolFilter().Should(filters...), nil
+	case notOp:
+		return elastic.NewBoolFilter().MustNot(
+			elastic.NewBoolFilter().Must(filters...)), nil
+	}
+	return nil, errors.New("Invalid filter type")
+}
+
 // AddExact implemented by ElasticSearch uses the 'term' directive.
 // Note that with strings, this might not return exact match results,
 // if the index is set to pre-process strings, which it does by default.
@@ -141,9 +240,59 @@ func (ef *ElasticFilter) AddRegex(field string,
 	return ef
 }
 
-// Order sorts the results for the given field.
-func (eq *ElasticQuery) Order(field string) search.Query {
-	eq.sort = field
+// AddRange uses range filter directive, with both ends inclusive.
+// A nil gte or lte leaves that end of the range open.
+func (ef *ElasticFilter) AddRange(field string,
+	gte, lte interface{}) search.FilterQuery {
+
+	rf := elastic.NewRangeFilter(field)
+	if gte != nil {
+		rf = rf.Gte(gte)
+	}
+	if lte != nil {
+		rf = rf.Lte(lte)
+	}
+	ef.filters = append(ef.filters, rf)
+	return ef
+}
+
+// AddPrefix uses prefix filter directive. Just like AddExact, this works
+// on the terms generated by the analyzer for strings, unless the field is
+// set to "index": "not_analyzed".
+func (ef *ElasticFilter) AddPrefix(field string,
+	prefix string) search.FilterQuery {
+
+	pf := elastic.NewPrefixFilter(field, prefix)
+	ef.filters = append(ef.filters, pf)
+	return ef
+}
+
+// AddMatch wraps a match query within a filter, so the text gets analyzed
+// before matching.
+func (ef *ElasticFilter) AddMatch(field string,
+	text string) search.FilterQuery {
+
+	qf := elastic.NewQueryFilter(elastic.NewMatchQuery(field, text))
+	ef.filters = append(ef.filters, qf)
+	return ef
+}
+
+// AddExists uses exists filter directive.
+func (ef *ElasticFilter) AddExists(field string) search.FilterQuery {
+	ef.filters = append(ef.filters, elastic.NewExistsFilter(field))
+	return ef
+}
+
+// AddMissing uses missing filter directive.
+func (ef *ElasticFilter) AddMissing(field string) search.FilterQuery {
+	ef.filters = append(ef.filters, elastic.NewMissingFilter(field))
+	return ef
+}
+
+// Order sorts the results by the given fields. ElasticSearch places docs
+// missing a field last, by default.
+func (eq *ElasticQuery) Order(fields ...string) search.Query {
+	eq.sort = fields
 	return eq
 }
 
@@ -159,35 +308,129 @@ func (eq *ElasticQuery) Limit(num int) search.Query {
 	return eq
 }
 
-func (eq *ElasticQuery) generateQuery() (rq elastic.FilteredQuery, rerr error) {
-	rq = elastic.NewFilteredQuery(elastic.NewMatchAllQuery())
-	if eq.filterType == 0 {
-		return rq, errors.New("Filter present, but not set")
+// After continues from the doc the cursor points to. ElasticSearch 1.x
+// has no search_after, so this filters for the docs placed after it, as
+// per the sort values stored within the cursor. String order fields need
+// to be declared via search.SetMapping as keyword or date fields, for this
+// to work. Otherwise, ErrCursorField is returned on Run.
+func (eq *ElasticQuery) After(cursor string) search.Query {
+	eq.after = cursor
+	return eq
+}
+
+// uid is how ElasticSearch identifies the doc across types, and sorts by.
+func (eq *ElasticQuery) uid(id string) string {
+	return eq.kind + "#" + id
+}
+
+// sortKey returns the values of the sort fields within doc, followed by
+// its id. Missing fields have nil values.
+func (eq *ElasticQuery) sortKey(doc x.Doc) []interface{} {
+	m, _ := doc.Data.(map[string]interface{})
+	key := make([]interface{}, 0, len(eq.sort)+1)
+	for _, field := range eq.sort {
+		key = append(key, m[dataField(field)])
+	}
+	return append(key, doc.Id)
+}
+
+// dataField strips the optional "-" and "data." prefixes, to return the
+// name of the field within Doc.Data.
+func dataField(field string) string {
+	field = strings.TrimPrefix(field, "-")
+	if len(field) > len("data.") && strings.ToLower(field[0:5]) == "data." {
+		field = field[5:]
+	}
+	return field
+}
+
+// afterFilter matches the docs placed after the one the cursor points to.
+// That is, the docs which have the same values for the first few sort
+// fields, and are beyond it for the next one. Docs with the same values for
+// all the fields are ordered by their uids.
+func (eq *ElasticQuery) afterFilter() (elastic.Filter, error) {
+	key, err := search.DecodeCursor(eq.after)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != len(eq.sort)+1 {
+		return nil, search.ErrInvalidCursor
+	}
+	id, ok := key[len(key)-1].(string)
+	if !ok {
+		return nil, search.ErrInvalidCursor
+	}
 
-	} else if eq.filterType == 1 {
-		af := elastic.NewAndFilter(eq.filter.filters...)
-		rq = rq.Filter(af)
+	mapping := search.Mappings()[eq.kind]
+	var same, should []elastic.Filter
+	for idx, field := range eq.sort {
+		val := key[idx]
+		if _, isstr := val.(string); isstr {
+			switch mapping[dataField(field)] {
+			case search.KeywordField, search.DateField:
+			default:
+				return nil, ErrCursorField
+			}
+		}
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		if val == nil {
+			// Missing values are placed last, so nothing is beyond them.
+			same = append(same, elastic.NewMissingFilter(field))
+			continue
+		}
+
+		rf := elastic.NewRangeFilter(field).Gt(val)
+		if desc {
+			rf = elastic.NewRangeFilter(field).Lt(val)
+		}
+		beyond := elastic.NewBoolFilter().Should(rf, elastic.NewMissingFilter(field))
+		must := append(append([]elastic.Filter{}, same...), beyond)
+		should = append(should, elastic.NewBoolFilter().Must(must...))
+		same = append(same, elastic.NewTermFilter(field, val))
+	}
+	uf := elastic.NewRangeFilter("_uid").Gt(eq.uid(id))
+	should = append(should, elastic.NewBoolFilter().Must(append(same, uf)...))
+	return elastic.NewBoolFilter().Should(should...), nil
+}
 
-	} else if eq.filterType == 2 {
-		of := elastic.NewOrFilter(eq.filter.filters...)
-		rq = rq.Filter(of)
+func (eq *ElasticQuery) generateQuery(
+	extra ...elastic.Filter) (rq elastic.FilteredQuery, rerr error) {
 
-	} else {
-		return rq, errors.New("Invalid filter type")
+	rq = elastic.NewFilteredQuery(elastic.NewMatchAllQuery())
+	filters := extra
+	if eq.filter != nil {
+		f, err := eq.filter.build()
+		if err != nil {
+			return rq, err
+		}
+		if f != nil {
+			filters = append(filters, f)
+		}
+	}
+	switch len(filters) {
+	case 0:
+	case 1:
+		rq = rq.Filter(filters[0])
+	default:
+		rq = rq.Filter(elastic.NewBoolFilter().Must(filters...))
 	}
 	return rq, nil
 }
 
-// Run runs the query and returns results and error, if any.
-func (eq *ElasticQuery) Run() (docs []x.Doc, rerr error) {
+func (eq *ElasticQuery) run(sorted bool) (docs []x.Doc, rerr error) {
 	ss := eq.client.Search("gocrud").Type(eq.kind)
-	if len(eq.sort) > 0 {
-		if eq.sort[:1] == "-" {
-			ss = ss.Sort(eq.sort[1:], false)
+	for _, field := range eq.sort {
+		if strings.HasPrefix(field, "-") {
+			ss = ss.Sort(field[1:], false)
 		} else {
-			ss = ss.Sort(eq.sort, true)
+			ss = ss.Sort(field, true)
 		}
 	}
+	if len(eq.sort) > 0 || len(eq.after) > 0 || sorted {
+		// Break ties, so the order is the same across runs.
+		ss = ss.Sort("_uid", true)
+	}
 	if eq.from > 0 {
 		ss = ss.From(eq.from)
 	}
@@ -195,8 +438,16 @@ func (eq *ElasticQuery) Run() (docs []x.Doc, rerr error) {
 		ss = ss.Size(eq.limit)
 	}
 
-	if eq.filter != nil {
-		q, err := eq.generateQuery()
+	var extra []elastic.Filter
+	if len(eq.after) > 0 {
+		f, err := eq.afterFilter()
+		if err != nil {
+			return docs, err
+		}
+		extra = append(extra, f)
+	}
+	if eq.filter != nil || len(extra) > 0 {
+		q, err := eq.generateQuery(extra...)
 		if err != nil {
 			return docs, err
 		}
@@ -222,6 +473,22 @@ func (eq *ElasticQuery) Run() (docs []x.Doc, rerr error) {
 	return docs, nil
 }
 
+// Run runs the query and returns results and error, if any.
+func (eq *ElasticQuery) Run() (docs []x.Doc, rerr error) {
+	return eq.run(false)
+}
+
+// RunWithCursor runs the query sorted by the uids after the order field,
+// and returns the cursor to the last doc.
+func (eq *ElasticQuery) RunWithCursor() (docs []x.Doc, cursor string, rerr error) {
+	docs, err := eq.run(true)
+	if err != nil || len(docs) == 0 {
+		return docs, "", err
+	}
+	cursor, err = search.EncodeCursor(eq.sortKey(docs[len(docs)-1]))
+	return docs, cursor, err
+}
+
 func (eq *ElasticQuery) Count() (rcount int64, rerr error) {
 	cs := eq.client.Count("gocrud").Type(eq.kind)
 	if eq.filter != nil {
@@ -234,6 +501,101 @@ func (eq *ElasticQuery) Count() (rcount int64, rerr error) {
 	return cs.Do()
 }
 
+// interval formats the duration in the largest time unit understood by
+// ElasticSearch, which divides it exactly.
+func interval(d time.Duration) string {
+	units := []struct {
+		suffix string
+		d      time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	for _, u := range units {
+		if d%u.d == 0 {
+			return fmt.Sprintf("%d%s", d/u.d, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
+// Aggregate runs the aggregations via ElasticSearch, without retrieving
+// any of the matching docs. Note that a Terms aggregation with size 0
+// returns all the terms.
+func (eq *ElasticQuery) Aggregate(
+	aggs ...search.Aggregation) (map[string]search.AggResult, error) {
+
+	ss := eq.client.Search("gocrud").Type(eq.kind).Size(0)
+	if eq.filter != nil {
+		q, err := eq.generateQuery()
+		if err != nil {
+			return nil, err
+		}
+		ss = ss.Query(q)
+	}
+	for _, agg := range aggs {
+		switch agg.Type {
+		case search.TermsAgg:
+			ss = ss.Aggregation(agg.Name,
+				elastic.NewTermsAggregation().Field(agg.Field).Size(agg.Size))
+		case search.StatsAgg:
+			ss = ss.Aggregation(agg.Name,
+				elastic.NewStatsAggregation().Field(agg.Field))
+		case search.DateHistogramAgg:
+			if agg.Interval < time.Millisecond {
+				return nil, fmt.Errorf("Invalid interval for date histogram: %v",
+					agg.Interval)
+			}
+			ss = ss.Aggregation(agg.Name, elastic.NewDateHistogramAggregation().
+				Field(agg.Field).Interval(interval(agg.Interval)))
+		default:
+			return nil, fmt.Errorf("Invalid aggregation type: %v", agg.Type)
+		}
+	}
+
+	result, err := ss.Do()
+	if err != nil {
+		x.LogErr(log, err).Error("While running aggregations")
+		return nil, err
+	}
+
+	results := make(map[string]search.AggResult)
+	for _, agg := range aggs {
+		var res search.AggResult
+		switch agg.Type {
+		case search.TermsAgg:
+			if items, found := result.Aggregations.Terms(agg.Name); found {
+				for _, b := range items.Buckets {
+					res.Buckets = append(res.Buckets,
+						search.Bucket{Key: b.Key, Count: b.DocCount})
+				}
+			}
+		case search.StatsAgg:
+			if stats, found := result.Aggregations.Stats(agg.Name); found {
+				res.Count = stats.Count
+				if stats.Count > 0 {
+					res.Min, res.Max = *stats.Min, *stats.Max
+					res.Sum, res.Avg = *stats.Sum, *stats.Avg
+				}
+			}
+		case search.DateHistogramAgg:
+			if items, found := result.Aggregations.DateHistogram(agg.Name); found {
+				for _, b := range items.Buckets {
+					if b.DocCount == 0 {
+						continue
+					}
+					res.Buckets = append(res.Buckets,
+						search.Bucket{Key: b.Key, Count: b.DocCount})
+				}
+			}
+		}
+		results[agg.Name] = res
+	}
+	return results, nil
+}
+
 // NewQuery creates a new query object, to return results of type kind.
 func (es *Elastic) NewQuery(kind string) search.Query {
 	eq := new(ElasticQuery)
@@ -244,5 +606,7 @@ func (es *Elastic) NewQuery(kind string) search.Query {
 
 func init() {
 	log.Info("Initing elasticsearch")
-	search.Register("elasticsearch", new(Elastic))
+	if err := search.Register("elasticsearch", new(Elastic)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
 }
@@ -1,11 +1,14 @@
 package elasticsearch
 
 import (
+	"encoding/json"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/manishrjain/gocrud/search"
 	"github.com/manishrjain/gocrud/testx"
+	"github.com/manishrjain/gocrud/x"
 )
 
 var galaxies = [...]string{
@@ -20,9 +23,16 @@ func initialize() *Elastic {
 		return nil
 	}
 
+	// Cursors need the string fields they're ordered by mapped as keywords.
+	search.SetMapping("Galaxy", search.Mapping{
+		"catalog":    search.KeywordField,
+		"label":      search.KeywordField,
+		"discovered": search.DateField,
+	})
 	es := new(Elastic)
 	es.Init("http://" + addr + ":9200")
 	es.DropIndex()
+	es.Init("http://" + addr + ":9200") // Recreate the index with mappings.
 	testx.AddDocs(es)
 	return es
 }
@@ -59,6 +69,122 @@ func TestFrom(t *testing.T) {
 	testx.RunFromLimit(es, t)
 }
 
+func TestRangeFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunRangeFilter(es, t)
+}
+
+func TestPrefixFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunPrefixFilter(es, t)
+}
+
+func TestMatchFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunMatchFilter(es, t)
+}
+
+func TestExistsFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunExistsFilter(es, t)
+}
+
+func TestNestedFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunNestedFilter(es, t)
+}
+
+func TestAggregate(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunAggregate(es, t)
+}
+
+func TestCursor(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunCursor(es, t)
+}
+
+func TestMultiOrder(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunMultiOrder(es, t)
+}
+
+// TestDelete only checks the versioning, because deletions take a refresh
+// to be reflected in search results.
+func TestDelete(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	doc := x.Doc{Kind: "Comet", Id: x.UniqueString(5), NanoTs: 10,
+		Data: map[string]interface{}{"name": "halley"}}
+	if err := es.Update(doc); err != nil {
+		t.Fatalf("While updating: %v", err)
+	}
+	if err := es.Delete(doc.Kind, doc.Id, 5); err == nil {
+		t.Error("Expected error while deleting with an older version")
+	}
+	if err := es.Delete(doc.Kind, doc.Id, 20); err != nil {
+		t.Errorf("While deleting: %v", err)
+	}
+	doc.NanoTs = 15
+	if err := es.Update(doc); err == nil {
+		t.Error("Expected error while updating with an older version")
+	}
+	if err := es.Delete(doc.Kind, x.UniqueString(5), 10); err != nil {
+		t.Errorf("While deleting missing doc: %v", err)
+	}
+}
+
+func TestMappingBody(t *testing.T) {
+	m := map[string]search.Mapping{
+		"Galaxy": {"name": search.KeywordField, "pos": search.LongField},
+	}
+	body, err := json.Marshal(mappingBody(m))
+	if err != nil {
+		t.Fatalf("While marshaling mapping: %v", err)
+	}
+	expected := `{"mappings":{"Galaxy":{"properties":{"Data":{"properties":` +
+		`{"name":{"index":"not_analyzed","type":"string"},"pos":{"type":"long"}}}}}}}`
+	if string(body) != expected {
+		t.Errorf("Expected: %v. Found: %v", expected, string(body))
+	}
+
+	// Any change in the mappings should result in a different index.
+	name := indexName(body)
+	m["Galaxy"]["pos"] = search.DoubleField
+	if body, err = json.Marshal(mappingBody(m)); err != nil {
+		t.Fatalf("While marshaling mapping: %v", err)
+	}
+	if indexName(body) == name {
+		t.Errorf("Expected a new index name. Found: %v", name)
+	}
+}
+
 var es *Elastic
 
 func init() {
@@ -0,0 +1,173 @@
+package elasticsearch
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/manishrjain/gocrud/search"
+	"github.com/manishrjain/gocrud/x"
+	"gopkg.in/olivere/elastic.v2"
+)
+
+// fieldMapping translates the field type into an ElasticSearch 1.x mapping.
+func fieldMapping(typ int) map[string]interface{} {
+	switch typ {
+	case search.KeywordField:
+		return map[string]interface{}{"type": "string", "index": "not_analyzed"}
+	case search.TextField:
+		return map[string]interface{}{"type": "string"}
+	case search.LongField:
+		return map[string]interface{}{"type": "long"}
+	case search.DoubleField:
+		return map[string]interface{}{"type": "double"}
+	case search.DateField:
+		return map[string]interface{}{"type": "date"}
+	}
+	return nil
+}
+
+// mappingBody generates the body to create the index with, having a type
+// mapping for each kind. Docs are indexed as x.Doc, so the fields declared
+// for a kind are mapped within its Data.
+func mappingBody(mappings map[string]search.Mapping) map[string]interface{} {
+	types := make(map[string]interface{})
+	for kind, m := range mappings {
+		props := make(map[string]interface{})
+		for field, typ := range m {
+			props[field] = fieldMapping(typ)
+		}
+		types[kind] = map[string]interface{}{
+			"properties": map[string]interface{}{
+				"Data": map[string]interface{}{"properties": props},
+			},
+		}
+	}
+	return map[string]interface{}{"mappings": types}
+}
+
+// indexName generates the name of the index holding the docs, as per the
+// hash of its body. So, any change in the mappings results in a new index.
+func indexName(body []byte) string {
+	sum := sha1.Sum(body)
+	return fmt.Sprintf("gocrud_%x", sum[:6])
+}
+
+// applyMappings makes sure the "gocrud" alias points to an index created
+// with the given mappings. If the mappings have changed, a new index is
+// created, the docs get copied over from the older index, and the alias is
+// switched to the new index. The older index is left as is, to be deleted
+// manually. Docs updated while copying might be missed, until they're
+// regenerated again by the indexer.
+func (es *Elastic) applyMappings(mappings map[string]search.Mapping) error {
+	body, err := json.Marshal(mappingBody(mappings))
+	if err != nil {
+		return err
+	}
+	name := indexName(body)
+
+	aliases, err := es.client.Aliases().Do()
+	if err != nil {
+		return err
+	}
+	old := aliases.IndicesByAlias("gocrud")
+	for _, idx := range old {
+		if idx == name {
+			log.WithField("index", name).Debug("Mappings up to date")
+			return nil
+		}
+	}
+
+	exists, err := es.client.IndexExists(name).Do()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		createIndex, err := es.client.CreateIndex(name).Body(string(body)).Do()
+		if err != nil {
+			return err
+		}
+		if !createIndex.Acknowledged {
+			log.WithField("index", name).Error("Create index not acknowledged")
+		}
+	}
+
+	// Before mappings, "gocrud" was created as an index; not as an alias.
+	legacy := false
+	if len(old) == 0 {
+		if legacy, err = es.client.IndexExists("gocrud").Do(); err != nil {
+			return err
+		}
+		if legacy {
+			old = append(old, "gocrud")
+		}
+	}
+	for _, idx := range old {
+		if err := es.reindex(idx, name); err != nil {
+			return err
+		}
+	}
+
+	if legacy {
+		// An alias can't have the same name as an existing index.
+		if _, err := es.client.DeleteIndex("gocrud").Do(); err != nil {
+			return err
+		}
+		old = nil
+	}
+	as := es.client.Alias().Add(name, "gocrud")
+	for _, idx := range old {
+		as = as.Remove(idx, "gocrud")
+	}
+	if _, err := as.Do(); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"index": name,
+		"older": old,
+	}).Info("Switched gocrud alias to new mappings")
+	return nil
+}
+
+// reindex copies all the docs from the src index to dst, retaining their
+// versions. Docs which dst already has, are skipped.
+func (es *Elastic) reindex(src, dst string) error {
+	cursor, err := es.client.Scan(src).Size(100).Do()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	var d x.Doc
+	for {
+		result, err := cursor.Next()
+		if err == elastic.EOS {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for _, item := range result.Each(reflect.TypeOf(d)) {
+			doc := item.(x.Doc)
+			_, err := es.client.Index().Index(dst).Type(doc.Kind).Id(doc.Id).
+				VersionType("external").Version(doc.NanoTs).BodyJson(doc).Do()
+			if e, ok := err.(*elastic.Error); ok && e.Status == http.StatusConflict {
+				continue
+			}
+			if err != nil {
+				x.LogErr(log, err).WithField("doc", doc).Error("While reindexing doc")
+				return err
+			}
+			count += 1
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"from": src,
+		"to":   dst,
+		"docs": count,
+	}).Info("Reindexed docs")
+	return nil
+}
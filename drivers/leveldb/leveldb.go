@@ -1,3 +1,8 @@
+// Package leveldb contains a store driver for Gocrud, backed by leveldb.
+// Every key starts with a type prefix, so the instructions keyed by
+// subject ids, and the reverse index keyed by object ids, never collide
+// irrespective of the characters used in the ids. Databases written before
+// the prefixes were introduced are migrated by Init.
 package leveldb
 
 import (
@@ -14,6 +19,28 @@ import (
 
 var log = x.Log("leveldb")
 
+// Key prefixes. Instructions are keyed by entityPrefix, the subject id,
+// sep and a unique suffix. The reverse index, mapping object ids to the
+// instructions pointing to them, is keyed by revPrefix, the object id,
+// sep and the key of the instruction.
+const (
+	entityPrefix = "e:"
+	revPrefix    = "r:"
+)
+
+// versionKey holds the version of the key layout, as per migrations.
+const versionKey = "m:version"
+
+// sep separates the id from the rest of the key. It sorts before any
+// character allowed in ids, so one id can't be mistaken as a prefix of
+// another.
+const sep = "\x00"
+
+// entityKeys returns the range of keys holding the instructions for id.
+func entityKeys(id string) *util.Range {
+	return util.BytesPrefix([]byte(entityPrefix + id + sep))
+}
+
 type Leveldb struct {
 	db  *leveldb.DB
 	opt *opt.Options
@@ -38,11 +65,14 @@ func (l *Leveldb) Init(args ...string) {
 		x.LogErr(log, err).Fatal("While opening leveldb")
 		return
 	}
+	if err := l.ensure(); err != nil {
+		x.LogErr(log, err).Fatal("While migrating keys")
+		return
+	}
 }
 
 func (l *Leveldb) IsNew(id string) bool {
-	slice := util.BytesPrefix([]byte(id))
-	iter := l.db.NewIterator(slice, nil)
+	iter := l.db.NewIterator(entityKeys(id), nil)
 	isnew := true
 	lg := log.WithField("id", id)
 	for iter.Next() {
@@ -61,12 +91,17 @@ func (l *Leveldb) IsNew(id string) bool {
 	return isnew
 }
 
+// Commit writes all the instructions via a single leveldb.Batch,
+// so they're applied atomically. Also, leveldb only allows a single process
+// to open the database. So, conditional updates via Update.IfUnchangedSince
+// are fully guarded by the locking done within store.
 func (l *Leveldb) Commit(its []*x.Instruction) error {
 	var keys []string
 	for _, it := range its {
 		var key string
 		for m := 0; m < 10; m++ {
-			key = fmt.Sprintf("%s_%s", it.SubjectId, x.UniqueString(5))
+			key = fmt.Sprintf("%s%s%s%s", entityPrefix, it.SubjectId, sep,
+				x.UniqueString(5))
 			log.WithField("key", key).Debug("Checking existence of key")
 			if has, err := l.db.Has([]byte(key), nil); err != nil {
 				x.LogErr(log, err).WithField("key", key).Error("While check if key exists")
@@ -92,6 +127,10 @@ func (l *Leveldb) Commit(its []*x.Instruction) error {
 			return err
 		}
 		b.Put(key, buf)
+		if len(it.ObjectId) > 0 {
+			// Primary key is unique, so the reverse key would be too.
+			b.Put([]byte(revPrefix+it.ObjectId+sep+keys[idx]), buf)
+		}
 	}
 	if err := l.db.Write(b, nil); err != nil {
 		x.LogErr(log, err).Error("While writing to db")
@@ -103,8 +142,7 @@ func (l *Leveldb) Commit(its []*x.Instruction) error {
 }
 
 func (l *Leveldb) GetEntity(id string) (result []x.Instruction, rerr error) {
-	slice := util.BytesPrefix([]byte(id))
-	iter := l.db.NewIterator(slice, nil)
+	iter := l.db.NewIterator(entityKeys(id), nil)
 	for iter.Next() {
 		buf := iter.Value()
 		if buf == nil {
@@ -125,10 +163,38 @@ func (l *Leveldb) GetEntity(id string) (result []x.Instruction, rerr error) {
 	return result, err
 }
 
+// GetIncoming retrieves all the instructions with the given object id,
+// via the reverse index.
+func (l *Leveldb) GetIncoming(id string) (result []x.Instruction, rerr error) {
+	slice := util.BytesPrefix([]byte(revPrefix + id + sep))
+	iter := l.db.NewIterator(slice, nil)
+	for iter.Next() {
+		var i x.Instruction
+		if err := i.GobDecode(iter.Value()); err != nil {
+			x.LogErr(log, err).Error("While decoding")
+			iter.Release()
+			return result, err
+		}
+		result = append(result, i)
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		x.LogErr(log, err).Error("While iterating")
+	}
+	return result, err
+}
+
+// Iterate pages over the entities in the order of their ids, starting
+// right after fromId.
 func (l *Leveldb) Iterate(fromId string, num int,
 	ch chan x.Entity) (rnum int, rlast x.Entity, rerr error) {
-	slice := util.Range{Start: []byte(fromId)}
-	iter := l.db.NewIterator(&slice, nil)
+	slice := util.BytesPrefix([]byte(entityPrefix))
+	if len(fromId) > 0 {
+		// Skip over the keys of fromId, which end in a unique suffix.
+		slice.Start = []byte(entityPrefix + fromId + sep + "\xff")
+	}
+	iter := l.db.NewIterator(slice, nil)
 
 	rnum = 0
 	handled := make(map[x.Entity]bool)
@@ -166,5 +232,7 @@ func init() {
 	log.Info("Initing leveldb")
 	l := new(Leveldb)
 	l.SetBloomFilter(13)
-	store.Register("leveldb", l)
+	if err := store.Register("leveldb", l); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
 }
@@ -0,0 +1,220 @@
+package leveldb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/manishrjain/gocrud/testx"
+	"github.com/manishrjain/gocrud/x"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func initialize(t *testing.T) (*Leveldb, string) {
+	dir, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := new(Leveldb)
+	l.Init(dir)
+	return l, dir
+}
+
+// Ids starting with ~, or with non-ASCII characters, shouldn't collide with
+// the reverse index.
+func TestUnusualIds(t *testing.T) {
+	l, dir := initialize(t)
+	defer os.RemoveAll(dir)
+
+	its := []*x.Instruction{
+		{SubjectId: "abc", SubjectType: "User", Predicate: "likes",
+			ObjectId: "tilde", NanoTs: 1},
+		{SubjectId: "über", SubjectType: "User", Predicate: "name", NanoTs: 2},
+		{SubjectId: "~tilde", SubjectType: "User", Predicate: "name", NanoTs: 3},
+	}
+	if err := l.Commit(its); err != nil {
+		t.Fatalf("While committing: %+v", err)
+	}
+
+	for _, id := range []string{"über", "~tilde"} {
+		result, err := l.GetEntity(id)
+		if err != nil {
+			t.Fatalf("While getting entity: %+v", err)
+		}
+		if len(result) != 1 || result[0].SubjectId != id {
+			t.Errorf("Expected 1 instruction for %v. Got: %+v", id, result)
+		}
+		if l.IsNew(id) {
+			t.Errorf("Expected %v to exist", id)
+		}
+	}
+	if !l.IsNew("tilde") {
+		t.Error("Expected tilde to be new")
+	}
+
+	incoming, err := l.GetIncoming("tilde")
+	if err != nil {
+		t.Fatalf("While getting incoming: %+v", err)
+	}
+	if len(incoming) != 1 || incoming[0].SubjectId != "abc" {
+		t.Errorf("Expected incoming edge from abc. Got: %+v", incoming)
+	}
+
+	ch := make(chan x.Entity, 10)
+	found, _, err := l.Iterate("", 10, ch)
+	if err != nil {
+		t.Fatalf("While iterating: %+v", err)
+	}
+	var ids []string
+	for i := 0; i < found; i++ {
+		ids = append(ids, (<-ch).Id)
+	}
+	expected := []string{"abc", "~tilde", "über"}
+	if len(ids) != len(expected) {
+		t.Fatalf("Expected %v. Got: %v", expected, ids)
+	}
+	for i, id := range expected {
+		if ids[i] != id {
+			t.Errorf("Expected %v. Got: %v", expected, ids)
+			break
+		}
+	}
+}
+
+func TestPrefixIds(t *testing.T) {
+	l, dir := initialize(t)
+	defer os.RemoveAll(dir)
+
+	its := []*x.Instruction{
+		{SubjectId: "abc", SubjectType: "User", Predicate: "name", NanoTs: 1},
+		{SubjectId: "abcd", SubjectType: "User", Predicate: "name", NanoTs: 2},
+	}
+	if err := l.Commit(its); err != nil {
+		t.Fatalf("While committing: %+v", err)
+	}
+	if !l.IsNew("ab") {
+		t.Error("Expected ab to be new")
+	}
+	result, err := l.GetEntity("abc")
+	if err != nil {
+		t.Fatalf("While getting entity: %+v", err)
+	}
+	if len(result) != 1 || result[0].SubjectId != "abc" {
+		t.Errorf("Expected 1 instruction for abc. Got: %+v", result)
+	}
+}
+
+// Databases written with the original key layout should be migrated on Init.
+func TestMigrateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key string, it x.Instruction) {
+		buf, err := it.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put([]byte(key), buf, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edge := x.Instruction{SubjectId: "alice", SubjectType: "User",
+		Predicate: "follows", ObjectId: "bob", NanoTs: 2}
+	put("alice_AbCdE", x.Instruction{SubjectId: "alice", SubjectType: "User",
+		Predicate: "name", NanoTs: 1})
+	put("alice_XyZ12", edge)
+	put("~bob_alice_XyZ12", edge)
+	put("bob_Qwert", x.Instruction{SubjectId: "bob", SubjectType: "User",
+		Predicate: "name", NanoTs: 3})
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 2; run++ {
+		l := new(Leveldb)
+		l.Init(dir)
+
+		if l.IsNew("alice") {
+			t.Error("Expected alice to exist")
+		}
+		result, err := l.GetEntity("alice")
+		if err != nil {
+			t.Fatalf("While getting entity: %+v", err)
+		}
+		if len(result) != 2 {
+			t.Errorf("Expected 2 instructions for alice. Got: %+v", result)
+		}
+		incoming, err := l.GetIncoming("bob")
+		if err != nil {
+			t.Fatalf("While getting incoming: %+v", err)
+		}
+		if len(incoming) != 1 || incoming[0].SubjectId != "alice" {
+			t.Errorf("Expected incoming edge from alice. Got: %+v", incoming)
+		}
+
+		ch := make(chan x.Entity, 10)
+		found, _, err := l.Iterate("", 10, ch)
+		if err != nil {
+			t.Fatalf("While iterating: %+v", err)
+		}
+		var ids []string
+		for i := 0; i < found; i++ {
+			ids = append(ids, (<-ch).Id)
+		}
+		if len(ids) != 2 || ids[0] != "alice" || ids[1] != "bob" {
+			t.Errorf("Expected alice and bob. Got: %v", ids)
+		}
+		if has, _ := l.db.Has([]byte("alice_AbCdE"), nil); has {
+			t.Error("Expected old keys to be removed")
+		}
+		if err := l.db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIterate(t *testing.T) {
+	l, dir := initialize(t)
+	defer os.RemoveAll(dir)
+	testx.RunIterate(l, t)
+}
+
+// Paging should resume right after the last entity, and come to an end.
+func TestIteratePages(t *testing.T) {
+	l, dir := initialize(t)
+	defer os.RemoveAll(dir)
+
+	its := []*x.Instruction{
+		{SubjectId: "a", SubjectType: "Post", Predicate: "body", NanoTs: 1},
+		{SubjectId: "a", SubjectType: "Post", Predicate: "tag", NanoTs: 2},
+		{SubjectId: "ab", SubjectType: "Post", Predicate: "body", NanoTs: 3},
+	}
+	if err := l.Commit(its); err != nil {
+		t.Fatalf("While committing: %+v", err)
+	}
+
+	ch := make(chan x.Entity, 10)
+	var ids []string
+	from := ""
+	for pages := 0; pages < 5; pages++ {
+		found, last, err := l.Iterate(from, 1, ch)
+		if err != nil {
+			t.Fatalf("While iterating: %+v", err)
+		}
+		if found == 0 {
+			break
+		}
+		ids = append(ids, (<-ch).Id)
+		from = last.Id
+	}
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "ab" {
+		t.Errorf("Expected a and ab. Got: %v", ids)
+	}
+}
@@ -0,0 +1,105 @@
+package leveldb
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/manishrjain/gocrud/store"
+	"github.com/manishrjain/gocrud/x"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// migrations lists the changes to the key layout, in order.
+// Append to this list, to change the layout.
+func (l *Leveldb) migrations() []store.Migration {
+	return []store.Migration{
+		{Version: 1, Apply: l.prefixKeys},
+	}
+}
+
+// ensure brings the database up to the latest key layout.
+func (l *Leveldb) ensure() error {
+	current := 0
+	buf, err := l.db.Get([]byte(versionKey), nil)
+	if err == nil {
+		if current, err = strconv.Atoi(string(buf)); err != nil {
+			return err
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	version, err := store.RunMigrations(current, l.migrations(),
+		func(v int) error {
+			return l.db.Put([]byte(versionKey), []byte(strconv.Itoa(v)), nil)
+		})
+	if err != nil {
+		return err
+	}
+	log.WithField("version", version).Debug("Keys are up to date")
+	return nil
+}
+
+// prefixKeys rewrites the keys from the original layout, where instructions
+// were keyed by the subject id, "_" and a unique suffix of 5 characters,
+// and the reverse index by "~", the object id, "_" and the instruction key.
+// The reverse index is regenerated from the instructions, so it also covers
+// the ones committed before it was introduced. Keys already in the current
+// layout are left as they are, so an interrupted run can be resumed.
+func (l *Leveldb) prefixKeys() error {
+	iter := l.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	count := 0
+	b := new(leveldb.Batch)
+	for iter.Next() {
+		key := string(iter.Key())
+		if key == versionKey {
+			continue
+		}
+		var i x.Instruction
+		if err := i.GobDecode(iter.Value()); err != nil {
+			x.LogErr(log, err).WithField("key", key).Error("While decoding")
+			return err
+		}
+
+		var suffix string
+		if len(key) > 5 {
+			suffix = key[len(key)-5:]
+		}
+		switch {
+		case key == entityPrefix+i.SubjectId+sep+suffix:
+			continue
+		case len(i.ObjectId) > 0 && strings.HasPrefix(key, revPrefix+i.ObjectId+sep):
+			continue
+		case len(key) == len(i.SubjectId)+6 && strings.HasPrefix(key, i.SubjectId+"_"):
+			nkey := entityPrefix + i.SubjectId + sep + suffix
+			b.Put([]byte(nkey), iter.Value())
+			if len(i.ObjectId) > 0 {
+				b.Put([]byte(revPrefix+i.ObjectId+sep+nkey), iter.Value())
+			}
+			count += 1
+		case len(i.ObjectId) > 0 && strings.HasPrefix(key, "~"+i.ObjectId+"_"):
+			// Regenerated along with the instruction it points to.
+		default:
+			log.WithField("key", key).Error("Unknown key")
+			continue
+		}
+		b.Delete(iter.Key())
+
+		if b.Len() >= 1000 {
+			if err := l.db.Write(b, nil); err != nil {
+				return err
+			}
+			b.Reset()
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := l.db.Write(b, nil); err != nil {
+		return err
+	}
+	log.WithField("instructions", count).Info("Migrated keys")
+	return nil
+}
@@ -7,6 +7,8 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/manishrjain/gocrud/search"
@@ -20,23 +22,47 @@ type MemSearch struct {
 }
 
 type MemQuery struct {
-	kind       string
-	Docs       []x.Doc
-	filter     *MemFilter
-	filterType int // 0 = no filter, 1 = AND, 2 = OR
-	from       int
-	limit      int
-	order      string
+	ms     *MemSearch
+	kind   string
+	Docs   []x.Doc
+	filter *MemFilter
+	from   int
+	limit  int
+	order  []string
+	after  string
 }
 
+// Types of filters, as added via MemFilter.
+const (
+	exactFilter = iota
+	regexFilter
+	rangeFilter
+	prefixFilter
+	matchFilter
+	existsFilter
+	missingFilter
+)
+
 type Filter struct {
 	Field string
 	Value interface{}
 	Regex string
+	Gte   interface{}
+	Lte   interface{}
+	typ   int
 }
 
+// Operators to combine the filters within a MemFilter.
+const (
+	andOp = iota + 1
+	orOp
+	notOp // Negated AND.
+)
+
 type MemFilter struct {
 	filters []Filter
+	subs    []*MemFilter // Nested clauses.
+	op      int
 }
 
 func (ms *MemSearch) Init(args ...string) {
@@ -46,19 +72,20 @@ func (ms *MemSearch) Init(args ...string) {
 func (ms *MemSearch) All() []x.Doc {
 	var dup []x.Doc
 	for _, doc := range ms.docs {
+		if doc.Deleted {
+			continue
+		}
 		dup = append(dup, doc)
 	}
 	return dup
 }
 
+// NewQuery creates a query for docs of the given kind. Docs are only
+// collected when the query is run, after applying the filters.
 func (ms *MemSearch) NewQuery(kind string) search.Query {
 	mq := new(MemQuery)
-	for _, doc := range ms.docs {
-		if doc.Kind != kind {
-			continue
-		}
-		mq.Docs = append(mq.Docs, doc)
-	}
+	mq.ms = ms
+	mq.kind = kind
 	return mq
 }
 
@@ -73,18 +100,39 @@ func (ms *MemSearch) Update(doc x.Doc) error {
 	return nil
 }
 
+// Delete replaces the doc with a tombstone, which retains its version.
+func (ms *MemSearch) Delete(kind, id string, nanoTs int64) error {
+	return ms.Update(x.Doc{Kind: kind, Id: id, NanoTs: nanoTs, Deleted: true})
+}
+
 func (mq *MemQuery) NewAndFilter() search.FilterQuery {
-	mq.filter = new(MemFilter)
-	mq.filterType = 1 // AND
+	mq.filter = &MemFilter{op: andOp}
 	return mq.filter
 }
 
 func (mq *MemQuery) NewOrFilter() search.FilterQuery {
-	mq.filter = new(MemFilter)
-	mq.filterType = 2 // OR
+	mq.filter = &MemFilter{op: orOp}
 	return mq.filter
 }
 
+func (mf *MemFilter) sub(op int) search.FilterQuery {
+	sub := &MemFilter{op: op}
+	mf.subs = append(mf.subs, sub)
+	return sub
+}
+
+func (mf *MemFilter) And() search.FilterQuery {
+	return mf.sub(andOp)
+}
+
+func (mf *MemFilter) Or() search.FilterQuery {
+	return mf.sub(orOp)
+}
+
+func (mf *MemFilter) Not() search.FilterQuery {
+	return mf.sub(notOp)
+}
+
 func (mf *MemFilter) AddExact(field string,
 	value interface{}) search.FilterQuery {
 
@@ -96,7 +144,45 @@ func (mf *MemFilter) AddExact(field string,
 func (mf *MemFilter) AddRegex(field string,
 	value string) search.FilterQuery {
 
-	filter := Filter{Field: field, Regex: value}
+	filter := Filter{Field: field, Regex: value, typ: regexFilter}
+	mf.filters = append(mf.filters, filter)
+	return mf
+}
+
+func (mf *MemFilter) AddRange(field string,
+	gte, lte interface{}) search.FilterQuery {
+
+	filter := Filter{Field: field, Gte: gte, Lte: lte, typ: rangeFilter}
+	mf.filters = append(mf.filters, filter)
+	return mf
+}
+
+func (mf *MemFilter) AddPrefix(field string,
+	prefix string) search.FilterQuery {
+
+	filter := Filter{Field: field, Value: prefix, typ: prefixFilter}
+	mf.filters = append(mf.filters, filter)
+	return mf
+}
+
+// AddMatch breaks both the text, and the field value into lower case terms
+// made of letters and digits, and matches if they have any term in common.
+func (mf *MemFilter) AddMatch(field string,
+	text string) search.FilterQuery {
+
+	filter := Filter{Field: field, Value: text, typ: matchFilter}
+	mf.filters = append(mf.filters, filter)
+	return mf
+}
+
+func (mf *MemFilter) AddExists(field string) search.FilterQuery {
+	filter := Filter{Field: field, typ: existsFilter}
+	mf.filters = append(mf.filters, filter)
+	return mf
+}
+
+func (mf *MemFilter) AddMissing(field string) search.FilterQuery {
+	filter := Filter{Field: field, typ: missingFilter}
 	mf.filters = append(mf.filters, filter)
 	return mf
 }
@@ -132,6 +218,121 @@ func matchRegex(doc x.Doc, field, value string) bool {
 	return false
 }
 
+// compare returns -1, 0 or 1 depending upon whether a is less than, equal to
+// or greater than b. Numbers of different types are compared as float64.
+// ok is false, if a and b can't be compared.
+func compare(a, b interface{}) (cmp int, ok bool) {
+	if fa, isnum := search.ToFloat(a); isnum {
+		fb, isnum := search.ToFloat(b)
+		if !isnum {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch va := a.(type) {
+	case string:
+		vb, isstr := b.(string)
+		if !isstr {
+			return 0, false
+		}
+		return strings.Compare(va, vb), true
+	case time.Time:
+		vb, istime := b.(time.Time)
+		if !istime {
+			return 0, false
+		}
+		switch {
+		case va.Before(vb):
+			return -1, true
+		case va.After(vb):
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func matchRange(doc x.Doc, field string, gte, lte interface{}) bool {
+	val, present := search.FieldValue(doc, field)
+	if !present {
+		return false
+	}
+	if gte != nil {
+		if cmp, ok := compare(val, gte); !ok || cmp < 0 {
+			return false
+		}
+	}
+	if lte != nil {
+		if cmp, ok := compare(val, lte); !ok || cmp > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func matchPrefix(doc x.Doc, field, prefix string) bool {
+	val, present := search.FieldValue(doc, field)
+	if !present {
+		return false
+	}
+	vals, ok := val.(string)
+	return ok && strings.HasPrefix(vals, prefix)
+}
+
+func terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func matchText(doc x.Doc, field, text string) bool {
+	val, present := search.FieldValue(doc, field)
+	if !present {
+		return false
+	}
+	vals, ok := val.(string)
+	if !ok {
+		return false
+	}
+	have := make(map[string]bool)
+	for _, t := range terms(vals) {
+		have[t] = true
+	}
+	for _, t := range terms(text) {
+		if have[t] {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(doc x.Doc, f Filter) bool {
+	switch f.typ {
+	case regexFilter:
+		return matchRegex(doc, f.Field, f.Regex)
+	case rangeFilter:
+		return matchRange(doc, f.Field, f.Gte, f.Lte)
+	case prefixFilter:
+		return matchPrefix(doc, f.Field, f.Value.(string))
+	case matchFilter:
+		return matchText(doc, f.Field, f.Value.(string))
+	case existsFilter:
+		_, present := search.FieldValue(doc, f.Field)
+		return present
+	case missingFilter:
+		_, present := search.FieldValue(doc, f.Field)
+		return !present
+	}
+	return matchExact(doc, f.Field, f.Value)
+}
+
 func (mq *MemQuery) From(num int) search.Query {
 	mq.from = num
 	return mq
@@ -142,179 +343,217 @@ func (mq *MemQuery) Limit(num int) search.Query {
 	return mq
 }
 
-func (mq *MemQuery) Order(field string) search.Query {
-	mq.order = field
+func (mq *MemQuery) Order(fields ...string) search.Query {
+	mq.order = fields
 	return mq
 }
 
+// Docs sorts the docs by their sort keys, as generated by MemQuery.sortKey.
 type Docs struct {
-	data  []x.Doc
-	field string
-	fn    func(i, j x.Doc)
-}
-
-func (d Docs) Len() int      { return len(d.data) }
-func (d Docs) Swap(i, j int) { d.data[i], d.data[j] = d.data[j], d.data[i] }
-func (d Docs) Get(i int) (val interface{}) {
-	di := d.data[i]
-	fi := di.Data.(map[string]interface{})
-	vi, pi := fi[d.field]
-	if !pi {
-		log.WithFields(logrus.Fields{
-			"field": d.field,
-			"data":  fi,
-		}).Fatal("Field not found for sorting")
-		return nil
-	}
-	return vi
-}
-func (d Docs) Less(i, j int) bool {
-	vi := d.Get(i)
-	vj := d.Get(j)
-	if reflect.TypeOf(vi) != reflect.TypeOf(vj) {
-		log.WithFields(logrus.Fields{
-			"vi":    vi,
-			"vj":    vj,
-			"field": d.field,
-		}).Fatal("Different types")
-		return false
-	}
-	switch t := vi.(type) {
-	case string:
-		return vi.(string) < vj.(string)
-	case int64:
-		return vi.(int64) < vj.(int64)
-	case int32:
-		return vi.(int32) < vj.(int32)
-	case int:
-		return vi.(int) < vj.(int)
-	case float64:
-		return vi.(float64) < vj.(float64)
-	default:
-		log.WithFields(logrus.Fields{
-			"vi":         vi,
-			"vj":         vj,
-			"field":      d.field,
-			"type_found": fmt.Sprintf("%T", t),
-		}).Fatal("Invalid type")
-	}
-
-	return false
+	data []x.Doc
+	keys [][]interface{}
+	mq   *MemQuery
+	err  error // First error encountered during sorting.
 }
 
-func (mq *MemQuery) bringOrder(field string) search.Query {
-	reverse := false
-	if strings.HasPrefix(field, "-") {
-		reverse = true
-		field = field[1:]
-	}
-	if len(field) > len("data.") && strings.ToLower(field[0:5]) == "data." {
-		field = field[5:]
-	}
-
-	eligible := mq.Docs[:0]
-	for _, doc := range mq.Docs {
-		fi := doc.Data.(map[string]interface{})
-		if _, pi := fi[field]; pi {
-			eligible = append(eligible, doc)
+func (d *Docs) Len() int { return len(d.data) }
+func (d *Docs) Swap(i, j int) {
+	d.data[i], d.data[j] = d.data[j], d.data[i]
+	d.keys[i], d.keys[j] = d.keys[j], d.keys[i]
+}
+func (d *Docs) Less(i, j int) bool {
+	cmp, err := d.mq.compareKeys(d.keys[i], d.keys[j])
+	if err != nil {
+		if d.err == nil {
+			d.err = err
 		}
+		return false
 	}
-	mq.Docs = eligible
+	return cmp < 0
+}
 
-	docs := Docs{data: mq.Docs, field: field}
-	if reverse {
-		sort.Sort(sort.Reverse(docs))
-	} else {
-		sort.Sort(docs)
+// sortKey returns the values of the order fields within doc, followed by
+// its id. Missing fields have nil values.
+func (mq *MemQuery) sortKey(doc x.Doc) []interface{} {
+	key := make([]interface{}, 0, len(mq.order)+1)
+	for _, field := range mq.order {
+		val, _ := search.FieldValue(doc, strings.TrimPrefix(field, "-"))
+		key = append(key, val)
 	}
-	return mq
+	return append(key, doc.Id)
 }
 
-func (mq *MemQuery) runAndFilter(filters []Filter) error {
-	docs := mq.Docs
-	filtered := docs[:0]
-	for _, doc := range docs {
-
-		for _, f := range filters {
-			if len(f.Field) == 0 {
-				return errors.New("Invalid field")
+// compareKeys compares the sort keys field by field, as per the order.
+// Docs missing a field are placed after the ones having it, irrespective
+// of the direction. Ties are broken by the doc ids, in ascending order.
+func (mq *MemQuery) compareKeys(a, b []interface{}) (int, error) {
+	for idx, field := range mq.order {
+		va, vb := a[idx], b[idx]
+		if va == nil || vb == nil {
+			if va != nil {
+				return -1, nil
 			}
+			if vb != nil {
+				return 1, nil
+			}
+			continue
+		}
 
-			if len(f.Regex) > 0 {
-				if m := matchRegex(doc, f.Field, f.Regex); m {
-					filtered = append(filtered, doc)
-					break // from filters.
-				}
-			} else {
-				if m := matchExact(doc, f.Field, f.Value); m {
-					filtered = append(filtered, doc)
-					break // from filters.
-				}
+		cmp, ok := compare(va, vb)
+		if !ok {
+			log.WithFields(logrus.Fields{
+				"va":    va,
+				"vb":    vb,
+				"field": field,
+			}).Error("Unable to compare for sorting")
+			if reflect.TypeOf(va) == reflect.TypeOf(vb) {
+				return 0, fmt.Errorf("Invalid type for sorting: %T", va)
 			}
+			return 0, search.ErrTypeMismatch
+		}
+		if strings.HasPrefix(field, "-") {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp, nil
 		}
 	}
-	mq.Docs = filtered
-	return nil
+	ia, _ := a[len(a)-1].(string)
+	ib, _ := b[len(b)-1].(string)
+	return strings.Compare(ia, ib), nil
 }
 
-func (mq *MemQuery) runOrFilter(filters []Filter) error {
-	docs := mq.Docs
-	filtered := docs[:0]
-	for _, doc := range docs {
+func (mq *MemQuery) bringOrder() error {
+	docs := &Docs{data: mq.Docs, mq: mq}
+	for _, doc := range mq.Docs {
+		docs.keys = append(docs.keys, mq.sortKey(doc))
+	}
+	sort.Sort(docs)
+	return docs.err
+}
 
-		match := false
-		for _, f := range filters {
-			if len(f.Field) == 0 {
-				return errors.New("Invalid field")
-			}
+// empty returns true if there are no filters within mf, or its clauses.
+func (mf *MemFilter) empty() bool {
+	if len(mf.filters) > 0 {
+		return false
+	}
+	for _, sub := range mf.subs {
+		if !sub.empty() {
+			return false
+		}
+	}
+	return true
+}
 
-			if len(f.Regex) > 0 {
-				if matchRegex(doc, f.Field, f.Regex) {
-					match = true
-					break // from filters
-				}
-			} else {
-				if matchExact(doc, f.Field, f.Value) {
-					match = true
-					break // from filters
-				}
-			}
+// match evaluates the filters, and the nested clauses recursively, and
+// combines their results as per the operator. Empty clauses are ignored.
+func (mf *MemFilter) match(doc x.Doc) (bool, error) {
+	total, matched := 0, 0
+	for _, f := range mf.filters {
+		if len(f.Field) == 0 {
+			return false, errors.New("Invalid field")
+		}
+		total += 1
+		if matches(doc, f) {
+			matched += 1
+		}
+	}
+	for _, sub := range mf.subs {
+		if sub.empty() {
+			continue
 		}
+		total += 1
+		m, err := sub.match(doc)
+		if err != nil {
+			return false, err
+		}
+		if m {
+			matched += 1
+		}
+	}
+	if total == 0 {
+		return true, nil
+	}
+
+	switch mf.op {
+	case andOp:
+		return matched == total, nil
+	case orOp:
+		return matched > 0, nil
+	case notOp:
+		return matched < total, nil
+	}
+	return false, errors.New("Invalid filter type")
+}
 
-		if match {
-			filtered = append(filtered, doc)
+// collect picks the docs of the query kind, which match the filters.
+func (mq *MemQuery) collect() error {
+	mq.Docs = nil
+	for _, doc := range mq.ms.docs {
+		if doc.Kind != mq.kind || doc.Deleted {
+			continue
+		}
+		if mq.filter != nil {
+			m, err := mq.filter.match(doc)
+			if err != nil {
+				return err
+			}
+			if !m {
+				continue
+			}
 		}
+		mq.Docs = append(mq.Docs, doc)
 	}
-	mq.Docs = filtered
 	return nil
 }
 
-func (mq *MemQuery) runFilter() error {
-	if mq.filterType == 0 {
-		return errors.New("Filter present, but not set")
+// After continues from the doc the cursor points to, as per the order.
+func (mq *MemQuery) After(cursor string) search.Query {
+	mq.after = cursor
+	return mq
+}
+
+// skipUntil drops the docs up to, and including the one the cursor
+// points to. Docs should already be sorted.
+func (mq *MemQuery) skipUntil(cursor string) error {
+	key, err := search.DecodeCursor(cursor)
+	if err != nil {
+		return err
+	}
+	if len(key) != len(mq.order)+1 {
+		return search.ErrInvalidCursor
+	}
+	if _, ok := key[len(key)-1].(string); !ok {
+		return search.ErrInvalidCursor
+	}
 
-	} else if mq.filterType == 1 {
-		if err := mq.runAndFilter(mq.filter.filters); err != nil {
+	for idx, doc := range mq.Docs {
+		cmp, err := mq.compareKeys(mq.sortKey(doc), key)
+		if err != nil {
 			return err
 		}
-	} else if mq.filterType == 2 {
-		if err := mq.runOrFilter(mq.filter.filters); err != nil {
-			return err
+		if cmp > 0 {
+			mq.Docs = mq.Docs[idx:]
+			return nil
 		}
-	} else {
-		return errors.New("Invalid filter type")
 	}
+	mq.Docs = mq.Docs[:0]
 	return nil
 }
 
-func (mq *MemQuery) Run() (docs []x.Doc, rerr error) {
-	if mq.filter != nil {
-		if err := mq.runFilter(); err != nil {
-			return docs, err
+func (mq *MemQuery) run(sortById bool) error {
+	if err := mq.collect(); err != nil {
+		return err
+	}
+	if len(mq.order) > 0 || len(mq.after) > 0 || sortById {
+		if err := mq.bringOrder(); err != nil {
+			return err
 		}
 	}
-	if len(mq.order) > 0 {
-		mq.bringOrder(mq.order)
+	if len(mq.after) > 0 {
+		if err := mq.skipUntil(mq.after); err != nil {
+			return err
+		}
 	}
 	if mq.from > 0 && mq.from < len(mq.Docs) {
 		mq.Docs = mq.Docs[mq.from:]
@@ -322,19 +561,47 @@ func (mq *MemQuery) Run() (docs []x.Doc, rerr error) {
 	if mq.limit > 0 && len(mq.Docs) > mq.limit {
 		mq.Docs = mq.Docs[0:mq.limit]
 	}
+	return nil
+}
+
+func (mq *MemQuery) Run() (docs []x.Doc, rerr error) {
+	if err := mq.run(false); err != nil {
+		return docs, err
+	}
 	return mq.Docs, nil
 }
 
+func (mq *MemQuery) RunWithCursor() (docs []x.Doc, cursor string, rerr error) {
+	if err := mq.run(true); err != nil {
+		return docs, "", err
+	}
+	if len(mq.Docs) == 0 {
+		return mq.Docs, "", nil
+	}
+	cursor, err := search.EncodeCursor(mq.sortKey(mq.Docs[len(mq.Docs)-1]))
+	return mq.Docs, cursor, err
+}
+
 func (mq *MemQuery) Count() (rcount int64, rerr error) {
-	if mq.filter != nil {
-		if err := mq.runFilter(); err != nil {
-			return 0, err
-		}
+	if err := mq.collect(); err != nil {
+		return 0, err
 	}
 	return int64(len(mq.Docs)), nil
 }
 
+// Aggregate computes the aggregations in memory, via search.AggregateDocs.
+func (mq *MemQuery) Aggregate(
+	aggs ...search.Aggregation) (map[string]search.AggResult, error) {
+
+	if err := mq.collect(); err != nil {
+		return nil, err
+	}
+	return search.AggregateDocs(mq.Docs, aggs...)
+}
+
 func init() {
 	log.Info("Initing memsearch")
-	search.Register("memsearch", new(MemSearch))
+	if err := search.Register("memsearch", new(MemSearch)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
 }
@@ -3,7 +3,9 @@ package memsearch
 import (
 	"testing"
 
+	"github.com/manishrjain/gocrud/search"
 	"github.com/manishrjain/gocrud/testx"
+	"github.com/manishrjain/gocrud/x"
 )
 
 func initialize() *MemSearch {
@@ -39,8 +41,62 @@ func TestFrom(t *testing.T) {
 	testx.RunFromLimit(ms, t)
 }
 
+func TestRangeFilter(t *testing.T) {
+	testx.RunRangeFilter(ms, t)
+}
+
+func TestPrefixFilter(t *testing.T) {
+	testx.RunPrefixFilter(ms, t)
+}
+
+func TestMatchFilter(t *testing.T) {
+	testx.RunMatchFilter(ms, t)
+}
+
+func TestExistsFilter(t *testing.T) {
+	testx.RunExistsFilter(ms, t)
+}
+
+func TestNestedFilter(t *testing.T) {
+	testx.RunNestedFilter(ms, t)
+}
+
+func TestAggregate(t *testing.T) {
+	testx.RunAggregate(ms, t)
+}
+
+func TestCursor(t *testing.T) {
+	testx.RunCursor(ms, t)
+}
+
+func TestMultiOrder(t *testing.T) {
+	testx.RunMultiOrder(ms, t)
+}
+
+func TestDelete(t *testing.T) {
+	testx.RunDelete(ms, t)
+}
+
 var ms *MemSearch
 
 func init() {
 	ms = initialize()
 }
+
+func TestOrderTypeMismatch(t *testing.T) {
+	ms := new(MemSearch)
+	ms.Init()
+	for i, pos := range []interface{}{1, "two"} {
+		var d x.Doc
+		d.Id = x.UniqueString(5)
+		d.Kind = "Mixed"
+		d.NanoTs = int64(i + 1)
+		d.Data = map[string]interface{}{"pos": pos}
+		if err := ms.Update(d); err != nil {
+			t.Fatalf("While updating: %v", err)
+		}
+	}
+	if _, err := ms.NewQuery("Mixed").Order("pos").Run(); err != search.ErrTypeMismatch {
+		t.Errorf("Expected ErrTypeMismatch. Got: %v", err)
+	}
+}
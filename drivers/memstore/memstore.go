@@ -0,0 +1,177 @@
+// Package memstore contains an in-memory store driver for Gocrud. It's
+// meant for tests and examples, so they can exercise Update.Execute and
+// Query.Run without setting up a database. Faults can be injected via
+// FailCommit and SetLatency, to test error handling.
+//
+// import _ "github.com/manishrjain/gocrud/drivers/memstore"
+// Initialize in main():
+// store.Get().Init()
+package memstore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/manishrjain/gocrud/store"
+	"github.com/manishrjain/gocrud/x"
+)
+
+var log = x.Log("memstore")
+
+// ErrInjected is returned by Commit, when asked to fail via FailCommit.
+var ErrInjected = errors.New("Injected failure")
+
+type MemStore struct {
+	sync.RWMutex
+	entities map[string][]x.Instruction // subject id -> instructions
+	kinds    map[string]string          // subject id -> subject type
+	incoming map[string][]x.Instruction // object id -> instructions
+	ids      []string                   // sorted subject ids, for Iterate
+
+	commits int
+	failAt  int
+	failErr error
+	latency time.Duration
+}
+
+// Init clears all the data in the store. It takes no arguments.
+func (ms *MemStore) Init(args ...string) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.entities = make(map[string][]x.Instruction)
+	ms.kinds = make(map[string]string)
+	ms.incoming = make(map[string][]x.Instruction)
+	ms.ids = nil
+}
+
+// FailCommit makes the nth Commit call from now on return err, without
+// writing anything. If err is nil, ErrInjected is returned instead.
+// Only the latest call to FailCommit is in effect, and n <= 0 turns it off.
+func (ms *MemStore) FailCommit(n int, err error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if err == nil {
+		err = ErrInjected
+	}
+	ms.commits = 0
+	ms.failAt = n
+	ms.failErr = err
+}
+
+// SetLatency adds a delay of d to every store operation.
+func (ms *MemStore) SetLatency(d time.Duration) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.latency = d
+}
+
+func (ms *MemStore) wait() {
+	ms.RLock()
+	d := ms.latency
+	ms.RUnlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Commit writes all the instructions under a single lock, so they're
+// applied atomically.
+func (ms *MemStore) Commit(its []*x.Instruction) error {
+	ms.wait()
+	ms.Lock()
+	defer ms.Unlock()
+
+	if ms.failAt > 0 {
+		ms.commits += 1
+		if ms.commits == ms.failAt {
+			ms.failAt = 0
+			log.WithField("error", ms.failErr).Debug("Failing commit")
+			return ms.failErr
+		}
+	}
+
+	for _, it := range its {
+		if _, present := ms.entities[it.SubjectId]; !present {
+			ms.kinds[it.SubjectId] = it.SubjectType
+			idx := sort.SearchStrings(ms.ids, it.SubjectId)
+			ms.ids = append(ms.ids, "")
+			copy(ms.ids[idx+1:], ms.ids[idx:])
+			ms.ids[idx] = it.SubjectId
+		}
+		ms.entities[it.SubjectId] = append(ms.entities[it.SubjectId], *it)
+		if len(it.ObjectId) > 0 {
+			ms.incoming[it.ObjectId] = append(ms.incoming[it.ObjectId], *it)
+		}
+	}
+	log.Debugf("%d instructions committed", len(its))
+	return nil
+}
+
+func (ms *MemStore) IsNew(subject string) bool {
+	ms.wait()
+	ms.RLock()
+	defer ms.RUnlock()
+
+	_, present := ms.entities[subject]
+	return !present
+}
+
+func (ms *MemStore) GetEntity(subject string) ([]x.Instruction, error) {
+	ms.wait()
+	ms.RLock()
+	defer ms.RUnlock()
+
+	its := ms.entities[subject]
+	result := make([]x.Instruction, len(its))
+	copy(result, its)
+	return result, nil
+}
+
+func (ms *MemStore) GetIncoming(object string) ([]x.Instruction, error) {
+	ms.wait()
+	ms.RLock()
+	defer ms.RUnlock()
+
+	its := ms.incoming[object]
+	result := make([]x.Instruction, len(its))
+	copy(result, its)
+	return result, nil
+}
+
+// Iterate pages over the entities in the order of their ids, starting
+// right after fromId.
+func (ms *MemStore) Iterate(fromId string, num int,
+	ch chan x.Entity) (found int, last x.Entity, rerr error) {
+
+	ms.wait()
+	ms.RLock()
+	var entities []x.Entity
+	idx := sort.SearchStrings(ms.ids, fromId)
+	for ; idx < len(ms.ids) && len(entities) < num; idx++ {
+		id := ms.ids[idx]
+		if id == fromId {
+			continue
+		}
+		entities = append(entities, x.Entity{Kind: ms.kinds[id], Id: id})
+	}
+	ms.RUnlock()
+
+	// Channel sends could block, so they're done outside the lock.
+	for _, e := range entities {
+		ch <- e
+		last = e
+		found += 1
+	}
+	return found, last, nil
+}
+
+func init() {
+	log.Info("Initing memstore")
+	if err := store.Register("memstore", new(MemStore)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
+}
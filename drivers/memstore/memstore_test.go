@@ -0,0 +1,138 @@
+package memstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/manishrjain/gocrud/req"
+	"github.com/manishrjain/gocrud/store"
+	"github.com/manishrjain/gocrud/testx"
+)
+
+func initialize() *MemStore {
+	ms := store.Get().(*MemStore)
+	ms.Init()
+	ms.FailCommit(0, nil)
+	ms.SetLatency(0)
+	return ms
+}
+
+func TestExecuteAndRun(t *testing.T) {
+	initialize()
+	c := req.NewContext(10)
+
+	u := store.NewUpdate("User", "alice").SetSource("alice")
+	u.Set("name", "Alice")
+	u.AddChild("Post").Set("body", "hello")
+	if err := u.Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+
+	result, err := store.NewQuery("alice").Collect("Post").Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if v := result.Columns["name"].Latest().Value; v != "Alice" {
+		t.Errorf("Expected name Alice. Got: %v", v)
+	}
+	if len(result.Children) != 1 {
+		t.Fatalf("Expected 1 post. Got: %+v", result.Children)
+	}
+	if v := result.Children[0].Columns["body"].Latest().Value; v != "hello" {
+		t.Errorf("Expected body hello. Got: %v", v)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	testx.RunIterate(initialize(), t)
+}
+
+func TestIncoming(t *testing.T) {
+	initialize()
+	c := req.NewContext(10)
+
+	if err := store.NewUpdate("Post", "pst").SetSource("bob").
+		Set("body", "hi").Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+	if err := store.NewUpdate("User", "carol").SetSource("carol").
+		AddEdge("likes", "Post", "pst").Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+
+	likers, err := store.NewQuery("pst").Incoming("likes")
+	if err != nil {
+		t.Fatalf("While retrieving incoming: %+v", err)
+	}
+	if len(likers) != 1 || likers[0].Id != "carol" {
+		t.Errorf("Expected carol as the only liker. Got: %+v", likers)
+	}
+}
+
+func TestFailCommit(t *testing.T) {
+	ms := initialize()
+	c := req.NewContext(10)
+
+	ms.FailCommit(2, nil)
+	for i := 1; i <= 3; i++ {
+		err := store.NewUpdate("Ticker", "GOOG").SetSource("nasdaq").
+			Set("price", i).Execute(c)
+		if i == 2 && err != ErrInjected {
+			t.Errorf("Expected ErrInjected. Got: %v", err)
+		}
+		if i != 2 && err != nil {
+			t.Errorf("When updating store: %+v", err)
+		}
+	}
+
+	result, err := store.NewQuery("GOOG").Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if n := result.Columns["price"].Count(); n != 2 {
+		t.Errorf("Expected 2 versions of price. Got: %v", n)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	ms := initialize()
+	ms.SetLatency(50 * time.Millisecond)
+	defer ms.SetLatency(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := store.NewQuery("GOOG").RunCtx(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded. Got: %v", err)
+	}
+}
+
+// Commits aren't abandoned once started, so the caller never sees an error
+// for instructions which get written anyway.
+func TestCommitCtxDeadline(t *testing.T) {
+	ms := initialize()
+	ms.SetLatency(50 * time.Millisecond)
+	defer ms.SetLatency(0)
+
+	c := req.NewContext(10)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := store.NewUpdate("User", "erin").SetSource("erin").Set("name", "Erin").
+		ExecuteCtx(ctx, c)
+	if err != nil {
+		t.Fatalf("Expected commit to finish. Got: %v", err)
+	}
+	if ms.IsNew("erin") {
+		t.Error("Expected erin to be committed")
+	}
+
+	// A context which is already done stops the commit from starting.
+	err = store.NewUpdate("User", "frank").SetSource("frank").Set("name", "Frank").
+		ExecuteCtx(ctx, c)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded. Got: %v", err)
+	}
+	if !ms.IsNew("frank") {
+		t.Error("Expected frank to not be committed")
+	}
+}
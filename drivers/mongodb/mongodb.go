@@ -18,9 +18,10 @@ var log = x.Log("mongodb")
 
 // MongoDB store backed by MongoDB
 type MongoDB struct {
-	session    *mgo.Session
-	database   string
-	collection string
+	session      *mgo.Session
+	database     string
+	collection   string
+	ensureSchema bool
 }
 
 // Init setup a new collection using the name provided
@@ -40,10 +41,20 @@ func (mdb *MongoDB) Init(args ...string) {
 	mdb.session = session
 	mdb.database = args[1]
 	mdb.collection = args[2]
+
+	if mdb.ensureSchema {
+		if err := mdb.ensure(); err != nil {
+			x.LogErr(log, err).Fatal("While ensuring schema")
+			return
+		}
+	}
 	log.Debug("Mongodb registered")
 }
 
-// Commit inserts the instructions into the collection as documents
+// Commit inserts the instructions into the collection as documents.
+// Note that instructions are inserted one by one, so a failure midway
+// would leave the ones before it written. Conditional updates via
+// Update.IfUnchangedSince are only atomic within a single process.
 func (mdb *MongoDB) Commit(its []*x.Instruction) error {
 	c := mdb.session.DB(mdb.database).C(mdb.collection)
 
@@ -51,7 +62,7 @@ func (mdb *MongoDB) Commit(its []*x.Instruction) error {
 		err := c.Insert(i)
 		if err != nil {
 			x.LogErr(log, err).Error("While executing batch")
-			return nil
+			return err
 		}
 	}
 
@@ -90,12 +101,25 @@ func (mdb *MongoDB) GetEntity(subject string) (result []x.Instruction, err error
 	return result, err
 }
 
+// GetIncoming retrieves all documents matching the object identifier
+func (mdb *MongoDB) GetIncoming(object string) (result []x.Instruction, err error) {
+	c := mdb.session.DB(mdb.database).C(mdb.collection)
+
+	err = c.Find(bson.M{"objectid": object}).All(&result)
+	if err != nil {
+		x.LogErr(log, err).Error("While running query")
+	}
+
+	return result, err
+}
+
 func (mdb *MongoDB) Iterate(fromId string, num int, ch chan x.Entity) (found int, last x.Entity, err error) {
-	log.Fatal("Not implemented")
-	return
+	return 0, last, store.ErrNotImplemented
 }
 
 func init() {
 	log.Info("Registering mongodb")
-	store.Register("mongodb", new(MongoDB))
+	if err := store.Register("mongodb", new(MongoDB)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
 }
@@ -0,0 +1,57 @@
+package mongodb
+
+import (
+	"github.com/manishrjain/gocrud/store"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// SetEnsureSchema, if called with true before Init, makes Init create the
+// indexes on the collection, if they don't already exist, and apply any
+// pending schema migrations. The schema version is tracked in a separate
+// collection, named after the instructions collection with a _schema suffix.
+func (mdb *MongoDB) SetEnsureSchema(ensure bool) {
+	mdb.ensureSchema = ensure
+}
+
+// migrations lists the schema changes for the collection, in order.
+// MongoDB creates the collection on first insert, so there's no need for
+// a migration to create it. Append to this list, to change the schema.
+func (mdb *MongoDB) migrations() []store.Migration {
+	return []store.Migration{
+		{Version: 1, Apply: mdb.createIndexes},
+	}
+}
+
+func (mdb *MongoDB) createIndexes() error {
+	c := mdb.session.DB(mdb.database).C(mdb.collection)
+	for _, key := range []string{"subjectid", "objectid", "nanots"} {
+		if err := c.EnsureIndexKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensure brings the collection up to the latest schema version.
+func (mdb *MongoDB) ensure() error {
+	vc := mdb.session.DB(mdb.database).C(mdb.collection + "_schema")
+
+	var doc struct {
+		Version int `bson:"version"`
+	}
+	if err := vc.FindId("schema").One(&doc); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	version, err := store.RunMigrations(doc.Version, mdb.migrations(),
+		func(v int) error {
+			_, err := vc.UpsertId("schema", bson.M{"$set": bson.M{"version": v}})
+			return err
+		})
+	if err != nil {
+		return err
+	}
+	log.WithField("version", version).Debug("Schema is up to date")
+	return nil
+}
@@ -0,0 +1,222 @@
+// Package redis contains a store driver for Gocrud, backed by Redis, or
+// anything else speaking its protocol. Instructions for each entity are
+// kept in a sorted set keyed by the subject id, and scored by NanoTs.
+// Entity ids are also registered in a separate sorted set, with equal
+// scores, so Iterate can page over them lexicographically.
+//
+// To test this redis integration, run redis on docker
+// $ docker run -d --name redis -p 6379:6379 redis:latest
+//
+// import _ "github.com/manishrjain/gocrud/drivers/redis"
+// Initialize in main():
+// store.Get().Init("127.0.0.1:6379")
+// OR, to keep all the keys under a prefix:
+// store.Get().Init("127.0.0.1:6379", "crud:")
+package redis
+
+import (
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/manishrjain/gocrud/store"
+	"github.com/manishrjain/gocrud/x"
+)
+
+var log = x.Log("redis")
+
+type Redis struct {
+	pool   *redigo.Pool
+	prefix string
+}
+
+func (r *Redis) Init(args ...string) {
+	if len(args) != 1 && len(args) != 2 {
+		log.WithField("args", args).Fatal("Invalid arguments")
+		return
+	}
+
+	addr := args[0]
+	if len(args) == 2 {
+		r.prefix = args[1]
+	}
+	r.pool = &redigo.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", addr)
+		},
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		x.LogErr(log, err).Fatal("While pinging redis")
+		return
+	}
+}
+
+// subjectKey is the sorted set holding instructions for the subject id.
+func (r *Redis) subjectKey(id string) string {
+	return r.prefix + "s:" + id
+}
+
+// objectKey is the sorted set holding instructions pointing to the object id.
+func (r *Redis) objectKey(id string) string {
+	return r.prefix + "o:" + id
+}
+
+// entitiesKey is the sorted set registering all the entity ids.
+func (r *Redis) entitiesKey() string {
+	return r.prefix + "entities"
+}
+
+// kindsKey is the hash mapping entity ids to their types.
+func (r *Redis) kindsKey() string {
+	return r.prefix + "kinds"
+}
+
+func (r *Redis) IsNew(subject string) bool {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	exists, err := redigo.Bool(conn.Do("HEXISTS", r.kindsKey(), subject))
+	if err != nil {
+		x.LogErr(log, err).Error("While checking is new")
+		return false
+	}
+	return !exists
+}
+
+// Commit sends all the instructions within a single MULTI/EXEC block, so
+// no other client sees them partially written. Note that Redis doesn't roll
+// back a transaction if a command within it fails; the error of the first
+// failed command is returned, but the rest of the commands stay applied.
+// Conditional updates via Update.IfUnchangedSince are only atomic within a
+// single process.
+func (r *Redis) Commit(its []*x.Instruction) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if err := conn.Send("MULTI"); err != nil {
+		x.LogErr(log, err).Error("While starting transaction")
+		return err
+	}
+	for _, it := range its {
+		buf, err := it.GobEncode()
+		if err != nil {
+			x.LogErr(log, err).Error("While encoding")
+			conn.Do("DISCARD")
+			return err
+		}
+		if err := r.queue(conn, it, buf); err != nil {
+			x.LogErr(log, err).Error("While queueing commands")
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+	replies, err := redigo.Values(conn.Do("EXEC"))
+	if err != nil {
+		x.LogErr(log, err).Error("While executing transaction")
+		return err
+	}
+	for _, reply := range replies {
+		if rerr, ok := reply.(redigo.Error); ok {
+			x.LogErr(log, rerr).Error("While executing command in transaction")
+			return rerr
+		}
+	}
+	log.Debugf("%d instructions committed", len(its))
+	return nil
+}
+
+// queue sends the commands storing the instruction, within the transaction
+// already started on conn.
+func (r *Redis) queue(conn redigo.Conn, it *x.Instruction, buf []byte) error {
+	if err := conn.Send("ZADD", r.subjectKey(it.SubjectId), it.NanoTs, buf); err != nil {
+		return err
+	}
+	if err := conn.Send("HSET", r.kindsKey(), it.SubjectId, it.SubjectType); err != nil {
+		return err
+	}
+	if err := conn.Send("ZADD", r.entitiesKey(), 0, it.SubjectId); err != nil {
+		return err
+	}
+	if len(it.ObjectId) > 0 {
+		return conn.Send("ZADD", r.objectKey(it.ObjectId), it.NanoTs, buf)
+	}
+	return nil
+}
+
+// members decodes all the instructions in the sorted set at key.
+func (r *Redis) members(key string) (result []x.Instruction, rerr error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	bufs, err := redigo.ByteSlices(conn.Do("ZRANGE", key, 0, -1))
+	if err != nil {
+		x.LogErr(log, err).Error("While retrieving members")
+		return result, err
+	}
+	for _, buf := range bufs {
+		var i x.Instruction
+		if err := i.GobDecode(buf); err != nil {
+			x.LogErr(log, err).Error("While decoding")
+			return result, err
+		}
+		result = append(result, i)
+	}
+	return result, nil
+}
+
+func (r *Redis) GetEntity(id string) ([]x.Instruction, error) {
+	return r.members(r.subjectKey(id))
+}
+
+// GetIncoming retrieves all the instructions with the given object id.
+func (r *Redis) GetIncoming(id string) ([]x.Instruction, error) {
+	return r.members(r.objectKey(id))
+}
+
+// Iterate pages over the entities in the order of their ids, starting
+// right after fromId.
+func (r *Redis) Iterate(fromId string, num int,
+	ch chan x.Entity) (found int, last x.Entity, rerr error) {
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	min := "-"
+	if len(fromId) > 0 {
+		min = "(" + fromId
+	}
+	ids, err := redigo.Strings(conn.Do("ZRANGEBYLEX", r.entitiesKey(), min, "+",
+		"LIMIT", 0, num))
+	if err != nil {
+		x.LogErr(log, err).Error("While retrieving entities")
+		return found, last, err
+	}
+	if len(ids) == 0 {
+		return found, last, nil
+	}
+
+	args := redigo.Args{}.Add(r.kindsKey()).AddFlat(ids)
+	kinds, err := redigo.Strings(conn.Do("HMGET", args...))
+	if err != nil {
+		x.LogErr(log, err).Error("While retrieving kinds")
+		return found, last, err
+	}
+	for idx, id := range ids {
+		e := x.Entity{Kind: kinds[idx], Id: id}
+		ch <- e
+		last = e
+		found += 1
+	}
+	return found, last, nil
+}
+
+func init() {
+	log.Info("Initing redis")
+	if err := store.Register("redis", new(Redis)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
+}
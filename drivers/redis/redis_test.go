@@ -0,0 +1,85 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/manishrjain/gocrud/testx"
+	"github.com/manishrjain/gocrud/x"
+)
+
+func initialize(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(Redis)
+	r.Init(mr.Addr(), "test:")
+	return r, mr
+}
+
+func TestCommit(t *testing.T) {
+	r, mr := initialize(t)
+	defer mr.Close()
+
+	if !r.IsNew("alice") {
+		t.Error("Expected alice to be new")
+	}
+	its := []*x.Instruction{
+		{SubjectId: "alice", SubjectType: "User", Predicate: "name",
+			Object: []byte("Alice"), NanoTs: 2},
+		{SubjectId: "alice", SubjectType: "User", Predicate: "follows",
+			ObjectId: "bob", NanoTs: 1},
+	}
+	if err := r.Commit(its); err != nil {
+		t.Fatalf("While committing: %+v", err)
+	}
+	if r.IsNew("alice") {
+		t.Error("Expected alice to exist")
+	}
+	if !mr.Exists("test:s:alice") {
+		t.Error("Expected keys to be prefixed")
+	}
+
+	result, err := r.GetEntity("alice")
+	if err != nil {
+		t.Fatalf("While getting entity: %+v", err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 instructions. Got: %+v", result)
+	}
+	if result[0].NanoTs != 1 || result[1].NanoTs != 2 {
+		t.Errorf("Expected instructions sorted by ts. Got: %+v", result)
+	}
+
+	incoming, err := r.GetIncoming("bob")
+	if err != nil {
+		t.Fatalf("While getting incoming: %+v", err)
+	}
+	if len(incoming) != 1 || incoming[0].SubjectId != "alice" {
+		t.Errorf("Expected incoming edge from alice. Got: %+v", incoming)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	r, mr := initialize(t)
+	defer mr.Close()
+	testx.RunIterate(r, t)
+}
+
+func TestCommitError(t *testing.T) {
+	r, mr := initialize(t)
+	defer mr.Close()
+
+	// HSET on a string fails with WRONGTYPE, within the transaction.
+	if err := mr.Set("test:kinds", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	its := []*x.Instruction{
+		{SubjectId: "alice", SubjectType: "User", Predicate: "name",
+			Object: []byte("Alice"), NanoTs: 1},
+	}
+	if err := r.Commit(its); err == nil {
+		t.Error("Expected error from failed command")
+	}
+}
@@ -10,6 +10,10 @@ package rethinkdb
 // table 'instructions'. Once created, create an index by going to
 // 'Data Explorer', and running this:
 // r.db('test').table('instructions').indexCreate('SubjectId')
+// r.db('test').table('instructions').indexCreate('ObjectId')
+// The ObjectId index is only needed for Query.Incoming.
+// Alternatively, call SetEnsureSchema(true) before Init, to have the driver
+// create the table and indexes.
 
 import (
 	r "github.com/dancannon/gorethink"
@@ -20,8 +24,9 @@ import (
 var log = x.Log("rethinkdb")
 
 type RethinkDB struct {
-	session *r.Session
-	table   string
+	session      *r.Session
+	table        string
+	ensureSchema bool
 }
 
 func (rdb *RethinkDB) SetSession(session *r.Session) {
@@ -48,6 +53,13 @@ func (rdb *RethinkDB) Init(args ...string) {
 	}
 	rdb.session = session
 	rdb.table = tablename
+
+	if rdb.ensureSchema {
+		if err := rdb.ensure(); err != nil {
+			x.LogErr(log, err).Fatal("While ensuring schema")
+			return
+		}
+	}
 }
 
 func (rdb *RethinkDB) IsNew(subject string) bool {
@@ -69,11 +81,14 @@ func (rdb *RethinkDB) IsNew(subject string) bool {
 	return isnew
 }
 
+// Commit inserts all the instructions in a single query. There's no
+// cross-process guarantee for Update.IfUnchangedSince; only writes from
+// within this process are checked atomically.
 func (rdb *RethinkDB) Commit(its []*x.Instruction) error {
 	res, err := r.Table(rdb.table).Insert(its).RunWrite(rdb.session)
 	if err != nil {
 		x.LogErr(log, err).Error("While executing batch")
-		return nil
+		return err
 	}
 
 	log.WithField("inserted", res.Inserted+res.Replaced).Debug("Stored instructions")
@@ -103,12 +118,79 @@ func (rdb *RethinkDB) GetEntity(subject string) (
 	return result, nil
 }
 
-func (rdb *RethinkDB) Iterate(fromId string, num int, ch chan x.Entity) (found int, last x.Entity, err error) {
-	log.Fatal("Not implemented")
-	return
+// GetIncoming retrieves all the instructions with the given object id,
+// via the ObjectId secondary index.
+func (rdb *RethinkDB) GetIncoming(object string) (
+	result []x.Instruction, rerr error,
+) {
+	iter, err := r.Table(rdb.table).GetAllByIndex("ObjectId", object).Run(rdb.session)
+	if err != nil {
+		x.LogErr(log, err).Error("While running query")
+		return result, err
+	}
+
+	err = iter.All(&result)
+	if err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		return result, err
+	}
+
+	if err := iter.Close(); err != nil {
+		x.LogErr(log, err).Error("While closing iterator")
+		return result, err
+	}
+
+	return result, nil
+}
+
+// Iterate pages over distinct entities in the order of their ids, starting
+// right after fromId, via the SubjectId secondary index. At most num
+// instructions are read per call, so the number of distinct entities found
+// might be lesser than num.
+func (rdb *RethinkDB) Iterate(fromId string, num int,
+	ch chan x.Entity) (found int, last x.Entity, rerr error) {
+
+	iter, err := r.Table(rdb.table).
+		Between(fromId, r.MaxVal, r.BetweenOpts{
+			Index:     "SubjectId",
+			LeftBound: "open",
+		}).
+		OrderBy(r.OrderByOpts{Index: "SubjectId"}).
+		Limit(num).
+		Pluck("SubjectId", "SubjectType").
+		Run(rdb.session)
+	if err != nil {
+		x.LogErr(log, err).Error("While running query")
+		return found, last, err
+	}
+
+	var i x.Instruction
+	handled := make(map[x.Entity]bool)
+	for iter.Next(&i) {
+		e := x.Entity{Kind: i.SubjectType, Id: i.SubjectId}
+		last = e
+		if _, present := handled[e]; present {
+			continue
+		}
+		ch <- e
+		handled[e] = true
+		found += 1
+	}
+	if err := iter.Err(); err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		iter.Close()
+		return found, last, err
+	}
+	if err := iter.Close(); err != nil {
+		x.LogErr(log, err).Error("While closing iterator")
+		return found, last, err
+	}
+	return found, last, nil
 }
 
 func init() {
 	log.Info("Registering rethinkdb")
-	store.Register("rethinkdb", new(RethinkDB))
+	if err := store.Register("rethinkdb", new(RethinkDB)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
 }
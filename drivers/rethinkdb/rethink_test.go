@@ -0,0 +1,38 @@
+package rethinkdb
+
+import (
+	"os"
+	"testing"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/manishrjain/gocrud/testx"
+	"github.com/manishrjain/gocrud/x"
+)
+
+func initialize() *RethinkDB {
+	addr := os.Getenv("RETHINKDB_PORT_28015_TCP_ADDR")
+	if len(addr) == 0 {
+		return nil
+	}
+
+	rdb := new(RethinkDB)
+	rdb.SetEnsureSchema(true)
+	rdb.Init(addr+":28015", "test", "instructions_"+x.UniqueString(5))
+	return rdb
+}
+
+// drop deletes the tables created for the test.
+func drop(rdb *RethinkDB) {
+	r.TableDrop(rdb.table).Exec(rdb.session)
+	r.TableDrop(rdb.table + "_schema").Exec(rdb.session)
+}
+
+func TestIterate(t *testing.T) {
+	rdb := initialize()
+	if rdb == nil {
+		t.Log("RethinkDB environment vars not set")
+		return
+	}
+	defer drop(rdb)
+	testx.RunIterate(rdb, t)
+}
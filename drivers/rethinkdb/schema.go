@@ -0,0 +1,105 @@
+package rethinkdb
+
+import (
+	r "github.com/dancannon/gorethink"
+	"github.com/manishrjain/gocrud/store"
+)
+
+// SetEnsureSchema, if called with true before Init, makes Init create the
+// table along with its SubjectId, ObjectId and NanoTs indexes, if they don't
+// already exist, and apply any pending schema migrations. The schema version
+// is tracked in a separate table, named after the instructions table with
+// a _schema suffix.
+func (rdb *RethinkDB) SetEnsureSchema(ensure bool) {
+	rdb.ensureSchema = ensure
+}
+
+// migrations lists the schema changes for the table, in order.
+// Append to this list, to change the schema.
+func (rdb *RethinkDB) migrations() []store.Migration {
+	return []store.Migration{
+		{Version: 1, Apply: func() error { return rdb.createTable(rdb.table) }},
+		{Version: 2, Apply: rdb.createIndexes},
+	}
+}
+
+func (rdb *RethinkDB) createTable(table string) error {
+	cur, err := r.TableList().Contains(table).Run(rdb.session)
+	if err != nil {
+		return err
+	}
+	var exists bool
+	if err := cur.One(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err = r.TableCreate(table).RunWrite(rdb.session)
+	return err
+}
+
+func (rdb *RethinkDB) createIndexes() error {
+	cur, err := r.Table(rdb.table).IndexList().Run(rdb.session)
+	if err != nil {
+		return err
+	}
+	var existing []string
+	if err := cur.All(&existing); err != nil {
+		return err
+	}
+	has := make(map[string]bool)
+	for _, idx := range existing {
+		has[idx] = true
+	}
+
+	for _, idx := range []string{"SubjectId", "ObjectId", "NanoTs"} {
+		if has[idx] {
+			continue
+		}
+		if _, err := r.Table(rdb.table).IndexCreate(idx).RunWrite(rdb.session); err != nil {
+			return err
+		}
+	}
+	return r.Table(rdb.table).IndexWait().Exec(rdb.session)
+}
+
+type schemaVersion struct {
+	Id      string `gorethink:"id"`
+	Version int    `gorethink:"version"`
+}
+
+// ensure creates the schema version table if needed, and brings the
+// instructions table up to the latest schema version.
+func (rdb *RethinkDB) ensure() error {
+	vtable := rdb.table + "_schema"
+	if err := rdb.createTable(vtable); err != nil {
+		return err
+	}
+
+	cur, err := r.Table(vtable).Get("schema").Run(rdb.session)
+	if err != nil {
+		return err
+	}
+	var current schemaVersion
+	if !cur.IsNil() {
+		if err := cur.One(&current); err != nil {
+			return err
+		}
+	}
+	if err := cur.Close(); err != nil {
+		return err
+	}
+
+	version, err := store.RunMigrations(current.Version, rdb.migrations(),
+		func(v int) error {
+			_, err := r.Table(vtable).Insert(schemaVersion{Id: "schema", Version: v},
+				r.InsertOpts{Conflict: "replace"}).RunWrite(rdb.session)
+			return err
+		})
+	if err != nil {
+		return err
+	}
+	log.WithField("version", version).Debug("Schema is up to date")
+	return nil
+}
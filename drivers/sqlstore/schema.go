@@ -0,0 +1,134 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/manishrjain/gocrud/store"
+)
+
+// SetEnsureSchema, if called with true before Init, makes Init create the
+// instructions table along with its indexes, if they don't already exist,
+// and apply any pending schema migrations. The schema version is tracked
+// in a separate table, named after the instructions table with a _schema
+// suffix.
+func (s *Sql) SetEnsureSchema(ensure bool) {
+	s.ensureSchema = ensure
+}
+
+// migrations lists the schema changes for the instructions table, in order.
+// Append to this list, to change the schema.
+func (s *Sql) migrations() []store.Migration {
+	return []store.Migration{
+		{Version: 1, Apply: s.createTable},
+		{Version: 2, Apply: s.createIndexes},
+	}
+}
+
+func (s *Sql) createTable() error {
+	var q string
+	switch s.dbtype {
+	case "postgres":
+		q = `create table if not exists %s (
+	subject_id varchar(32),
+	subject_type varchar(32),
+	predicate varchar(255),
+	object bytea,
+	object_id varchar(32),
+	nano_ts bigint,
+	source text,
+	id serial primary key)`
+	case "sqlite":
+		q = `create table if not exists %s (
+	subject_id varchar(32),
+	subject_type varchar(32),
+	predicate varchar(255),
+	object blob,
+	object_id varchar(32),
+	nano_ts bigint,
+	source text,
+	id integer primary key autoincrement)`
+	default:
+		q = `create table if not exists %s (
+	subject_id varchar(32),
+	subject_type varchar(32),
+	predicate varchar(255),
+	object blob,
+	object_id varchar(32),
+	nano_ts bigint,
+	source text,
+	id integer auto_increment,
+	primary key (id))`
+	}
+	_, err := s.db.Exec(fmt.Sprintf(q, s.table))
+	return err
+}
+
+// createIndexes creates the indexes, skipping the ones which already exist.
+// MySQL doesn't support "if not exists" for indexes, so they're looked up
+// in information_schema instead.
+func (s *Sql) createIndexes() error {
+	ifNotExists := s.dbtype == "postgres" || s.dbtype == "sqlite"
+	create := "create index"
+	if ifNotExists {
+		create = "create index if not exists"
+	}
+	for _, col := range []string{"subject_id", "object_id", "nano_ts"} {
+		name := fmt.Sprintf("%s_%s", s.table, col)
+		if !ifNotExists {
+			exists, err := s.indexExists(name)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+		}
+		q := fmt.Sprintf("%s %s on %s (%s)", create, name, s.table, col)
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexExists checks if the instructions table has an index with the given
+// name, in the current MySQL database.
+func (s *Sql) indexExists(name string) (bool, error) {
+	var count int
+	err := s.db.QueryRow(`select count(*) from information_schema.statistics
+	where table_schema = database() and table_name = ? and index_name = ?`,
+		s.table, name).Scan(&count)
+	return count > 0, err
+}
+
+// ensure creates the schema version table if needed, and brings the
+// instructions table up to the latest schema version.
+func (s *Sql) ensure() error {
+	vtable := s.table + "_schema"
+	if _, err := s.db.Exec(fmt.Sprintf(
+		"create table if not exists %s (version integer)", vtable)); err != nil {
+		return err
+	}
+
+	var current sql.NullInt64
+	if err := s.db.QueryRow(fmt.Sprintf(
+		"select max(version) from %s", vtable)).Scan(&current); err != nil {
+		return err
+	}
+
+	insert := fmt.Sprintf("insert into %s (version) values (?)", vtable)
+	if s.dbtype == "postgres" {
+		insert = fmt.Sprintf("insert into %s (version) values ($1)", vtable)
+	}
+	version, err := store.RunMigrations(int(current.Int64), s.migrations(),
+		func(v int) error {
+			_, err := s.db.Exec(insert, v)
+			return err
+		})
+	if err != nil {
+		return err
+	}
+	log.WithField("version", version).Debug("Schema is up to date")
+	return nil
+}
@@ -1,6 +1,7 @@
 package sqlstore
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
 
@@ -11,12 +12,23 @@ import (
 var log = x.Log("sqlstore")
 
 type Sql struct {
-	db *sql.DB
+	db           *sql.DB
+	dbtype       string
+	table        string
+	ensureSchema bool
+
+	// Queries generated by Init, as per the database type and table name.
+	sqlIsNew, sqlSelect, sqlIncoming, sqlScan string
 }
 
-var sqlInsert *sql.Stmt
-var sqlIsNew, sqlSelect string
+// maxRowsPerInsert limits the number of rows inserted by a single statement,
+// to stay well within the bind parameter limits of databases.
+const maxRowsPerInsert = 100
 
+// Init takes the database/sql driver name, the connection string and the
+// table name. The driver itself needs to be imported by the caller. Besides
+// "mysql" and "postgres", "sqlite" is supported via the pure Go driver at
+// github.com/glebarez/go-sqlite, which needs no cgo, or any server running.
 func (s *Sql) Init(args ...string) {
 	if len(args) != 3 {
 		log.WithField("args", args).Fatal("Invalid arguments")
@@ -38,35 +50,67 @@ func (s *Sql) Init(args ...string) {
 		x.LogErr(log, err).Fatal("While pinging db")
 		return
 	}
+	s.dbtype = dbtype
+	s.table = tablename
+
+	if s.ensureSchema {
+		if err := s.ensure(); err != nil {
+			x.LogErr(log, err).Fatal("While ensuring schema")
+			return
+		}
+	}
 
-	var insert string
 	switch dbtype {
 	case "postgres":
-		insert = fmt.Sprintf(`insert into %s (subject_id, subject_type, predicate,
-	object, object_id, nano_ts, source) values ($1, $2, $3, $4, $5, $6, $7)`, tablename)
-		sqlIsNew = fmt.Sprintf("select subject_id from %s where subject_id = $1 limit 1",
+		s.sqlIsNew = fmt.Sprintf("select subject_id from %s where subject_id = $1 limit 1",
 			tablename)
-		sqlSelect = fmt.Sprintf(`select subject_id, subject_type, predicate,
+		s.sqlSelect = fmt.Sprintf(`select subject_id, subject_type, predicate,
 	object, object_id, nano_ts, source from %s where subject_id = $1`, tablename)
+		s.sqlIncoming = fmt.Sprintf(`select subject_id, subject_type, predicate,
+	object, object_id, nano_ts, source from %s where object_id = $1`, tablename)
+		s.sqlScan = fmt.Sprintf(`select distinct subject_id, subject_type from %s
+	where subject_id > $1 order by subject_id limit $2`, tablename)
 
 	default:
-		insert = fmt.Sprintf(`insert into %s (subject_id, subject_type, predicate,
-	object, object_id, nano_ts, source) values (?, ?, ?, ?, ?, ?, ?)`, tablename)
-		sqlIsNew = fmt.Sprintf("select subject_id from %s where subject_id = ? limit 1",
+		s.sqlIsNew = fmt.Sprintf("select subject_id from %s where subject_id = ? limit 1",
 			tablename)
-		sqlSelect = fmt.Sprintf(`select subject_id, subject_type, predicate,
+		s.sqlSelect = fmt.Sprintf(`select subject_id, subject_type, predicate,
 	object, object_id, nano_ts, source from %s where subject_id = ?`, tablename)
-
+		s.sqlIncoming = fmt.Sprintf(`select subject_id, subject_type, predicate,
+	object, object_id, nano_ts, source from %s where object_id = ?`, tablename)
+		s.sqlScan = fmt.Sprintf(`select distinct subject_id, subject_type from %s
+	where subject_id > ? order by subject_id limit ?`, tablename)
 	}
+}
 
-	sqlInsert, err = s.db.Prepare(insert)
-	if err != nil {
-		panic(err)
+// insertQuery generates a multi-row insert statement for num rows, with
+// placeholders as per the database type.
+func (s *Sql) insertQuery(num int) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `insert into %s (subject_id, subject_type, predicate,
+	object, object_id, nano_ts, source) values `, s.table)
+	for r := 0; r < num; r++ {
+		if r > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString("(")
+		for c := 0; c < 7; c++ {
+			if c > 0 {
+				buf.WriteString(", ")
+			}
+			if s.dbtype == "postgres" {
+				fmt.Fprintf(&buf, "$%d", r*7+c+1)
+			} else {
+				buf.WriteString("?")
+			}
+		}
+		buf.WriteString(")")
 	}
+	return buf.String()
 }
 
 func (s *Sql) IsNew(subject string) bool {
-	rows, err := s.db.Query(sqlIsNew, subject)
+	rows, err := s.db.Query(s.sqlIsNew, subject)
 	if err != nil {
 		x.LogErr(log, err).Error("While checking is new")
 		return false
@@ -89,26 +133,70 @@ func (s *Sql) IsNew(subject string) bool {
 	return isnew
 }
 
+// Commit inserts the instructions into the table via multi-row inserts,
+// all within a single transaction. So, either all the instructions get
+// written, or none do. Versions expected via Update.IfUnchangedSince are
+// checked outside the database, so writes from other processes sharing
+// the same table aren't detected as conflicts.
 func (s *Sql) Commit(its []*x.Instruction) error {
-	for _, it := range its {
-		if _, err := sqlInsert.Exec(it.SubjectId, it.SubjectType, it.Predicate,
-			it.Object, it.ObjectId, it.NanoTs, it.Source); err != nil {
+	tx, err := s.db.Begin()
+	if err != nil {
+		x.LogErr(log, err).Error("While starting transaction")
+		return err
+	}
 
-			x.LogErr(log, err).Error("While inserting row in sql")
+	for start := 0; start < len(its); start += maxRowsPerInsert {
+		end := start + maxRowsPerInsert
+		if end > len(its) {
+			end = len(its)
+		}
+		var args []interface{}
+		for _, it := range its[start:end] {
+			args = append(args, it.SubjectId, it.SubjectType, it.Predicate,
+				it.Object, it.ObjectId, it.NanoTs, it.Source)
+		}
+		if _, err := tx.Exec(s.insertQuery(end-start), args...); err != nil {
+			x.LogErr(log, err).Error("While inserting rows in sql")
+			if rerr := tx.Rollback(); rerr != nil {
+				x.LogErr(log, rerr).Error("While rolling back transaction")
+			}
 			return err
 		}
 	}
+
+	if err := tx.Commit(); err != nil {
+		x.LogErr(log, err).Error("While committing transaction")
+		return err
+	}
+	log.WithField("len", len(its)).Debug("Stored instructions")
 	return nil
 }
 
 func (s *Sql) GetEntity(subject string) (
 	result []x.Instruction, rerr error) {
 
-	rows, err := s.db.Query(sqlSelect, subject)
+	rows, err := s.db.Query(s.sqlSelect, subject)
 	if err != nil {
 		x.LogErr(log, err).Error("While querying for entity")
 		return result, err
 	}
+	return scanInstructions(rows)
+}
+
+// GetIncoming retrieves all the rows with the given object id. For this to
+// be fast, the table should have an index on the object_id column.
+func (s *Sql) GetIncoming(object string) (
+	result []x.Instruction, rerr error) {
+
+	rows, err := s.db.Query(s.sqlIncoming, object)
+	if err != nil {
+		x.LogErr(log, err).Error("While querying for incoming")
+		return result, err
+	}
+	return scanInstructions(rows)
+}
+
+func scanInstructions(rows *sql.Rows) (result []x.Instruction, rerr error) {
 	defer rows.Close()
 
 	for rows.Next() {
@@ -122,7 +210,7 @@ func (s *Sql) GetEntity(subject string) (
 		result = append(result, i)
 	}
 
-	err = rows.Err()
+	err := rows.Err()
 	if err != nil {
 		x.LogErr(log, err).Error("While finishing up on rows")
 		return result, err
@@ -130,12 +218,44 @@ func (s *Sql) GetEntity(subject string) (
 	return result, nil
 }
 
-func (s *Sql) Iterate(fromId string, num int, ch chan x.Entity) (found int, last x.Entity, err error) {
-	log.Fatal("Not implemented")
-	return
+// Iterate pages over distinct entities in the order of their ids, starting
+// right after fromId. This uses keyset pagination, so each call only reads
+// the rows it needs, irrespective of how deep into the table it is.
+func (s *Sql) Iterate(fromId string, num int,
+	ch chan x.Entity) (found int, last x.Entity, rerr error) {
+
+	rows, err := s.db.Query(s.sqlScan, fromId, num)
+	if err != nil {
+		x.LogErr(log, err).Error("While querying for entities")
+		return found, last, err
+	}
+	defer rows.Close()
+
+	handled := make(map[x.Entity]bool)
+	for rows.Next() {
+		var e x.Entity
+		if err := rows.Scan(&e.Id, &e.Kind); err != nil {
+			x.LogErr(log, err).Error("While scanning")
+			return found, last, err
+		}
+		last = e
+		if _, present := handled[e]; present {
+			continue
+		}
+		ch <- e
+		handled[e] = true
+		found += 1
+	}
+	if err = rows.Err(); err != nil {
+		x.LogErr(log, err).Error("While finishing up on rows")
+		return found, last, err
+	}
+	return found, last, nil
 }
 
 func init() {
 	log.Info("Initing sqlstore")
-	store.Register("sqlstore", new(Sql))
+	if err := store.Register("sqlstore", new(Sql)); err != nil {
+		x.LogErr(log, err).Error("While registering")
+	}
 }
@@ -0,0 +1,127 @@
+package sqlstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/manishrjain/gocrud/testx"
+	"github.com/manishrjain/gocrud/x"
+)
+
+func newSqlite(t *testing.T) (*Sql, string) {
+	dir, err := ioutil.TempDir("", "sqlstore_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Sql)
+	s.SetEnsureSchema(true)
+	s.Init("sqlite", filepath.Join(dir, "test.db")+
+		"?_pragma=busy_timeout(5000)", "instructions")
+	return s, dir
+}
+
+func TestSqliteCommit(t *testing.T) {
+	s, dir := newSqlite(t)
+	defer os.RemoveAll(dir)
+
+	if !s.IsNew("alice") {
+		t.Error("Expected alice to be new")
+	}
+
+	// More than maxRowsPerInsert, to span multiple insert statements.
+	var its []*x.Instruction
+	for i := 0; i < 2*maxRowsPerInsert+1; i++ {
+		its = append(its, &x.Instruction{
+			SubjectId:   "alice",
+			SubjectType: "User",
+			Predicate:   "age",
+			Object:      []byte{byte(i)},
+			NanoTs:      int64(i),
+			Source:      "test",
+		})
+	}
+	its = append(its, &x.Instruction{
+		SubjectId:   "alice",
+		SubjectType: "User",
+		Predicate:   "follows",
+		ObjectId:    "bob",
+		NanoTs:      1000,
+		Source:      "test",
+	})
+	if err := s.Commit(its); err != nil {
+		t.Fatalf("While committing: %+v", err)
+	}
+	if s.IsNew("alice") {
+		t.Error("Expected alice to exist")
+	}
+
+	result, err := s.GetEntity("alice")
+	if err != nil {
+		t.Fatalf("While getting entity: %+v", err)
+	}
+	if len(result) != len(its) {
+		t.Errorf("Expected %d instructions. Got: %d", len(its), len(result))
+	}
+
+	incoming, err := s.GetIncoming("bob")
+	if err != nil {
+		t.Fatalf("While getting incoming: %+v", err)
+	}
+	if len(incoming) != 1 || incoming[0].SubjectId != "alice" {
+		t.Errorf("Expected incoming edge from alice. Got: %+v", incoming)
+	}
+}
+
+func TestSqliteRollback(t *testing.T) {
+	s, dir := newSqlite(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := s.db.Exec(`create unique index instructions_uniq
+	on instructions (subject_id, nano_ts)`); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last row violates the unique index, failing the last of the
+	// insert statements, after the earlier ones have gone through.
+	var its []*x.Instruction
+	for i := 0; i < 2*maxRowsPerInsert+1; i++ {
+		its = append(its, &x.Instruction{
+			SubjectId:   "carol",
+			SubjectType: "User",
+			Predicate:   "age",
+			Object:      []byte{byte(i)},
+			NanoTs:      int64(i),
+			Source:      "test",
+		})
+	}
+	its = append(its, &x.Instruction{
+		SubjectId:   "carol",
+		SubjectType: "User",
+		Predicate:   "age",
+		NanoTs:      0,
+		Source:      "test",
+	})
+	if err := s.Commit(its); err == nil {
+		t.Fatal("Expected error on commit")
+	}
+
+	if !s.IsNew("carol") {
+		t.Error("Expected carol to be new")
+	}
+	result, err := s.GetEntity("carol")
+	if err != nil {
+		t.Fatalf("While getting entity: %+v", err)
+	}
+	if len(result) != 0 {
+		t.Errorf("Expected no instructions after rollback. Got: %d", len(result))
+	}
+}
+
+func TestSqliteIterate(t *testing.T) {
+	s, dir := newSqlite(t)
+	defer os.RemoveAll(dir)
+	testx.RunIterate(s, t)
+}
@@ -10,3 +10,9 @@ create table instructions (
 	id integer auto_increment,
 	primary key (id)
 );
+create index instructions_object_id on instructions (object_id);
+create index instructions_subject_id on instructions (subject_id);
+create index instructions_nano_ts on instructions (nano_ts);
+
+create table instructions_schema (version integer);
+insert into instructions_schema (version) values (2);
@@ -0,0 +1,15 @@
+create table instructions (
+	subject_id varchar(32),
+	subject_type varchar(32),
+	predicate varchar(255),
+	object blob,
+	object_id varchar(32),
+	nano_ts bigint,
+	source text,
+	id integer primary key autoincrement);
+create index instructions_object_id on instructions (object_id);
+create index instructions_subject_id on instructions (subject_id);
+create index instructions_nano_ts on instructions (nano_ts);
+
+create table instructions_schema (version integer);
+insert into instructions_schema (version) values (2);
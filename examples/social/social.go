@@ -86,6 +86,10 @@ func (si SimpleIndexer) Regenerate(e x.Entity) (rdoc x.Doc) {
 			x.LogErr(log, err).Fatal("While querying db")
 			return rdoc
 		}
+		if len(result.Id) == 0 {
+			rdoc.Deleted = true // Remove deleted entities from search.
+			return rdoc
+		}
 		data := result.ToMap()
 		data["activity"] = len(result.Children)
 		rdoc.Data = data
@@ -96,6 +100,10 @@ func (si SimpleIndexer) Regenerate(e x.Entity) (rdoc x.Doc) {
 			x.LogErr(log, err).Fatal("While querying db")
 			return rdoc
 		}
+		if len(result.Id) == 0 {
+			rdoc.Deleted = true
+			return rdoc
+		}
 		rdoc.Data = result.ToMap()
 	}
 
@@ -160,6 +168,14 @@ func main() {
 	defer os.RemoveAll(dirname)
 	store.Get().Init(dirname)
 
+	// Declare the field types for engines with typed mappings, like
+	// Elasticsearch. This needs to be done before initializing the engine.
+	search.SetMapping("Post", search.Mapping{
+		"url":      search.KeywordField,
+		"body":     search.TextField,
+		"activity": search.LongField,
+	})
+
 	// Initialize Elasticsearch.
 	// search.Get().Init("http://192.168.59.103:9200")
 
@@ -1,6 +1,7 @@
 package indexer
 
 import (
+	"errors"
 	"sort"
 	"sync"
 
@@ -26,9 +27,16 @@ type Indexer interface {
 	// Regenerate would be called on entities which need to be reprocessed
 	// due to a change. The workflow is:
 	// store.Commit -> search.OnUpdate -> Regenerate
+	// If the entity has been deleted, return a doc with Deleted set, to
+	// have it removed from the search engine.
 	Regenerate(x.Entity) x.Doc
 }
 
+var (
+	ErrNilIndexer       = errors.New("nil indexer")
+	ErrDuplicateIndexer = errors.New("Another driver is already handling the same entity kind")
+)
+
 var (
 	mutex    sync.RWMutex
 	indexers = make(map[string]Indexer)
@@ -54,10 +62,11 @@ func processUpdates(c *req.Context) {
 			}
 			doc := didxr.Regenerate(de)
 			log.WithField("doc", doc).Debug("Regenerated doc")
-			if search.Get() == nil {
+			engine := search.GetNamed(c.Search)
+			if engine == nil {
 				continue
 			}
-			err := search.Get().Update(doc)
+			err := apply(engine, doc)
 			if err != nil {
 				x.LogErr(log, err).WithField("doc", doc).
 					Error("While updating in search engine")
@@ -67,6 +76,15 @@ func processUpdates(c *req.Context) {
 	log.Info("Finished processing channel")
 }
 
+// apply updates the doc in the search engine, or deletes it from there,
+// if the doc is a tombstone.
+func apply(engine search.Engine, doc x.Doc) error {
+	if doc.Deleted {
+		return engine.Delete(doc.Kind, doc.Id, doc.NanoTs)
+	}
+	return engine.Update(doc)
+}
+
 func Run(c *req.Context, numRoutines int) {
 	if numRoutines <= 0 {
 		log.WithField("num_routines", numRoutines).
@@ -86,19 +104,22 @@ func WaitForDone(c *req.Context) {
 	wg.Wait()
 }
 
-func Register(kind string, driver Indexer) {
+// Register sets the indexer for the given entity kind. Returns
+// ErrDuplicateIndexer if another indexer is already handling that kind.
+func Register(kind string, driver Indexer) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 	if driver == nil {
-		log.WithField("kind", kind).Fatal("nil indexer")
-		return
+		log.WithField("kind", kind).Error("nil indexer")
+		return ErrNilIndexer
 	}
 	if _, dup := indexers[kind]; dup {
-		log.WithField("kind", kind).Fatal(
+		log.WithField("kind", kind).Error(
 			"Another driver is already handling the same entity kind")
-		return
+		return ErrDuplicateIndexer
 	}
 	indexers[kind] = driver
+	return nil
 }
 
 func Get(kind string) (i Indexer, p bool) {
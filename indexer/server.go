@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/manishrjain/gocrud/req"
 	"github.com/manishrjain/gocrud/search"
 	"github.com/manishrjain/gocrud/store"
 	"github.com/manishrjain/gocrud/x"
@@ -13,8 +14,10 @@ import (
 // Incremental indexing server to continously regenerate
 // and index entities to keep store and search in-sync.
 type Server struct {
-	ch chan x.Entity
-	wg *sync.WaitGroup
+	ch     chan x.Entity
+	wg     *sync.WaitGroup
+	store  store.Store
+	engine search.Engine
 }
 
 // NewServer returns back a server which runs continously in
@@ -22,11 +25,26 @@ type Server struct {
 // You can control the amount of memory consumed by the server
 // via buffer of pending entities in the channel, and the
 // rate of processing of these entities via numRoutines.
+// The default store driver and search engine are used.
 func NewServer(buffer int, numRoutines int) *Server {
-	if search.Get() == nil {
-		log.Fatal("No search engine found")
+	return NewServerForContext(nil, buffer, numRoutines)
+}
+
+// NewServerForContext works like NewServer, but iterates over the store
+// driver and indexes into the search engine picked by c, just like Run.
+// A nil c refers to the default ones.
+func NewServerForContext(c *req.Context, buffer int, numRoutines int) *Server {
+	var sname, ename string
+	if c != nil {
+		sname, ename = c.Store, c.Search
 	}
 	s := new(Server)
+	if s.store = store.GetNamed(sname); s.store == nil {
+		log.Fatal("No store driver found")
+	}
+	if s.engine = search.GetNamed(ename); s.engine == nil {
+		log.Fatal("No search engine found")
+	}
 	s.ch = make(chan x.Entity, buffer)
 	s.wg = new(sync.WaitGroup)
 	for i := 0; i < numRoutines; i++ {
@@ -47,7 +65,7 @@ func (s *Server) regenerateAndIndex() {
 
 		doc := idxr.Regenerate(entity)
 		log.WithField("doc", doc).Debug("Regenerated doc")
-		if err := search.Get().Update(doc); err != nil {
+		if err := apply(s.engine, doc); err != nil {
 			x.LogErr(log, err).WithField("doc", doc).
 				Error("While updating in search engine")
 		}
@@ -59,7 +77,7 @@ func (s *Server) LoopOnce() {
 	var total uint64
 	from := ""
 	for {
-		found, last, err := store.Get().Iterate(from, 1000, s.ch)
+		found, last, err := s.store.Iterate(from, 1000, s.ch)
 		if err != nil {
 			x.LogErr(log, err).Error("While iterating")
 			return
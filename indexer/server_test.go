@@ -1,11 +1,14 @@
 package indexer_test
 
 import (
+	"io/ioutil"
+	"testing"
 	"time"
 
 	_ "github.com/manishrjain/gocrud/drivers/leveldb"
-	_ "github.com/manishrjain/gocrud/drivers/memsearch"
+	"github.com/manishrjain/gocrud/drivers/memsearch"
 	"github.com/manishrjain/gocrud/indexer"
+	"github.com/manishrjain/gocrud/req"
 	"github.com/manishrjain/gocrud/search"
 	"github.com/manishrjain/gocrud/store"
 	"github.com/manishrjain/gocrud/x"
@@ -39,3 +42,41 @@ func ExampleServer() {
 	server.LoopOnce()
 	server.Finish() // Finish is only useful when you're looping once.
 }
+
+func TestNamedEngine(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+	search.Get().Init("memsearch")
+	archive := new(memsearch.MemSearch)
+	archive.Init()
+	if err = search.Register("archive", archive); err != nil {
+		t.Fatalf("While registering: %v", err)
+	}
+	indexer.Register("Archived", SimpleIndexer{})
+
+	c := req.NewContext(10)
+	if err = store.NewUpdate("Archived", "old").SetSource("author").
+		Set("body", "archived").Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+
+	c.Search = "archive"
+	server := indexer.NewServerForContext(c, 10, 1)
+	server.LoopOnce()
+	server.Finish()
+
+	if docs := archive.All(); len(docs) != 1 || docs[0].Id != "old" {
+		t.Errorf("Expected doc in archive engine. Got: %+v", docs)
+	}
+	count, err := search.Get().NewQuery("Archived").Count()
+	if err != nil {
+		t.Fatalf("While counting: %+v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no docs in default engine. Got: %v", count)
+	}
+}
@@ -13,6 +13,8 @@ type Context struct {
 	NumCharsUnique int // 62^num unique strings
 	Updates        chan x.Entity
 	HasIndexer     bool
+	Store          string // Name of the store driver to use. Default if empty.
+	Search         string // Name of the search engine to use. Default if empty.
 }
 
 func NewContext(numChars int) *Context {
@@ -0,0 +1,262 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/manishrjain/gocrud/x"
+)
+
+// Types of aggregations.
+const (
+	TermsAgg = iota + 1
+	StatsAgg
+	DateHistogramAgg
+)
+
+// Aggregation describes a facet to be computed over the docs matching
+// a query. Use Terms, Stats and DateHistogram to create one.
+type Aggregation struct {
+	Name     string
+	Type     int
+	Field    string
+	Size     int           // Max number of buckets for TermsAgg.
+	Interval time.Duration // Bucket width for DateHistogramAgg.
+}
+
+// Terms buckets the docs by the distinct values of field, and returns the
+// size most frequent ones, most frequent first. Array values contribute
+// each of their elements. Engines which analyze strings bucket by terms.
+func Terms(name, field string, size int) Aggregation {
+	return Aggregation{Name: name, Type: TermsAgg, Field: field, Size: size}
+}
+
+// Stats computes count, min, max, sum and avg of the numeric field.
+func Stats(name, field string) Aggregation {
+	return Aggregation{Name: name, Type: StatsAgg, Field: field}
+}
+
+// DateHistogram buckets the docs by the date in field, into buckets of
+// the given interval, ordered by time. Dates are expected as milliseconds
+// since epoch, and bucket keys are returned the same way. Only buckets
+// with docs in them are returned.
+func DateHistogram(name, field string, interval time.Duration) Aggregation {
+	return Aggregation{Name: name, Type: DateHistogramAgg, Field: field,
+		Interval: interval}
+}
+
+// Bucket holds the number of docs having the key, or falling within the
+// bucket starting at key.
+type Bucket struct {
+	Key   interface{}
+	Count int64
+}
+
+// AggResult holds the result of an Aggregation. Buckets are filled for
+// TermsAgg and DateHistogramAgg, and the rest for StatsAgg.
+type AggResult struct {
+	Buckets []Bucket
+
+	Count int64
+	Min   float64
+	Max   float64
+	Sum   float64
+	Avg   float64
+}
+
+// AggregateDocs computes the aggregations in memory over the given docs.
+// Engines without native support for aggregations can use this. Returns
+// the results keyed by aggregation name.
+func AggregateDocs(docs []x.Doc,
+	aggs ...Aggregation) (map[string]AggResult, error) {
+
+	results := make(map[string]AggResult)
+	for _, agg := range aggs {
+		var res AggResult
+		var err error
+		switch agg.Type {
+		case TermsAgg:
+			res, err = aggTerms(docs, agg)
+		case StatsAgg:
+			res, err = aggStats(docs, agg)
+		case DateHistogramAgg:
+			res, err = aggDateHistogram(docs, agg)
+		default:
+			err = fmt.Errorf("Invalid aggregation type: %v", agg.Type)
+		}
+		if err != nil {
+			return results, err
+		}
+		results[agg.Name] = res
+	}
+	return results, nil
+}
+
+// FieldValue returns the value of field in doc data, and whether it's
+// present and non-null. The field may be prefixed with "data.", as used
+// by ElasticSearch.
+func FieldValue(doc x.Doc, field string) (interface{}, bool) {
+	if len(field) > len("data.") && strings.ToLower(field[0:5]) == "data." {
+		field = field[5:]
+	}
+	fields, ok := doc.Data.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	val, present := fields[field]
+	return val, present && val != nil
+}
+
+// ToFloat converts numbers of any of the int and float types to float64,
+// so they can be compared with each other. Returns false for non numbers.
+func ToFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+// byCount sorts buckets by count, most frequent first. Ties are broken
+// by key, to keep the order deterministic.
+type byCount []Bucket
+
+func (b byCount) Len() int      { return len(b) }
+func (b byCount) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCount) Less(i, j int) bool {
+	if b[i].Count != b[j].Count {
+		return b[i].Count > b[j].Count
+	}
+	return fmt.Sprintf("%v", b[i].Key) < fmt.Sprintf("%v", b[j].Key)
+}
+
+// byTime sorts date histogram buckets by their keys.
+type byTime []Bucket
+
+func (b byTime) Len() int           { return len(b) }
+func (b byTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTime) Less(i, j int) bool { return b[i].Key.(int64) < b[j].Key.(int64) }
+
+func aggTerms(docs []x.Doc, agg Aggregation) (res AggResult, rerr error) {
+	counts := make(map[interface{}]int64)
+	add := func(v interface{}) {
+		// Numbers of different types are bucketed together.
+		if f, ok := ToFloat(v); ok {
+			v = f
+		}
+		switch v.(type) {
+		case string, float64, bool:
+			counts[v] += 1
+		}
+	}
+
+	for _, doc := range docs {
+		val, present := FieldValue(doc, agg.Field)
+		if !present {
+			continue
+		}
+		switch vals := val.(type) {
+		case []interface{}:
+			for _, v := range vals {
+				add(v)
+			}
+		case []string:
+			for _, v := range vals {
+				add(v)
+			}
+		default:
+			add(val)
+		}
+	}
+
+	for k, c := range counts {
+		res.Buckets = append(res.Buckets, Bucket{Key: k, Count: c})
+	}
+	sort.Sort(byCount(res.Buckets))
+	if agg.Size > 0 && len(res.Buckets) > agg.Size {
+		res.Buckets = res.Buckets[:agg.Size]
+	}
+	return res, nil
+}
+
+func aggStats(docs []x.Doc, agg Aggregation) (res AggResult, rerr error) {
+	for _, doc := range docs {
+		val, present := FieldValue(doc, agg.Field)
+		if !present {
+			continue
+		}
+		f, ok := ToFloat(val)
+		if !ok {
+			return res, ErrTypeMismatch
+		}
+		if res.Count == 0 || f < res.Min {
+			res.Min = f
+		}
+		if res.Count == 0 || f > res.Max {
+			res.Max = f
+		}
+		res.Sum += f
+		res.Count += 1
+	}
+	if res.Count > 0 {
+		res.Avg = res.Sum / float64(res.Count)
+	}
+	return res, nil
+}
+
+// toMillis converts numbers, time.Time and RFC3339 strings to milliseconds
+// since epoch.
+func toMillis(v interface{}) (int64, bool) {
+	if f, ok := ToFloat(v); ok {
+		return int64(f), true
+	}
+	switch t := v.(type) {
+	case time.Time:
+		return t.UnixNano() / int64(time.Millisecond), true
+	case string:
+		if tm, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return tm.UnixNano() / int64(time.Millisecond), true
+		}
+	}
+	return 0, false
+}
+
+func aggDateHistogram(docs []x.Doc, agg Aggregation) (res AggResult, rerr error) {
+	width := int64(agg.Interval / time.Millisecond)
+	if width <= 0 {
+		return res, fmt.Errorf("Invalid interval for date histogram: %v", agg.Interval)
+	}
+
+	counts := make(map[int64]int64)
+	for _, doc := range docs {
+		val, present := FieldValue(doc, agg.Field)
+		if !present {
+			continue
+		}
+		ms, ok := toMillis(val)
+		if !ok {
+			return res, ErrTypeMismatch
+		}
+		key := ms / width * width
+		if key > ms {
+			key -= width // Round down, for dates before epoch.
+		}
+		counts[key] += 1
+	}
+
+	for k, c := range counts {
+		res.Buckets = append(res.Buckets, Bucket{Key: k, Count: c})
+	}
+	sort.Sort(byTime(res.Buckets))
+	return res, nil
+}
@@ -0,0 +1,130 @@
+package search
+
+import (
+	"context"
+
+	"github.com/manishrjain/gocrud/x"
+)
+
+// CtxEngine is implemented by search engines which natively support
+// cancellation and deadlines via context.Context. Engines which don't,
+// can be adapted via WithContext.
+type CtxEngine interface {
+	Engine
+
+	// UpdateCtx is the same as Update, but returns ctx.Err() without
+	// updating the index, if ctx is already done. Once started, an update
+	// is never abandoned.
+	UpdateCtx(ctx context.Context, doc x.Doc) error
+
+	// DeleteCtx is the same as Delete, but returns ctx.Err() without
+	// updating the index, if ctx is already done. Once started, a delete
+	// is never abandoned.
+	DeleteCtx(ctx context.Context, kind, id string, nanoTs int64) error
+}
+
+// CtxQuery is implemented by queries which natively support cancellation
+// and deadlines. Other queries can be adapted via QueryWithContext.
+type CtxQuery interface {
+	Query
+
+	// RunCtx is the same as Run, but returns once ctx is done.
+	RunCtx(ctx context.Context) ([]x.Doc, error)
+
+	// CountCtx is the same as Count, but returns once ctx is done.
+	CountCtx(ctx context.Context) (int64, error)
+}
+
+type ctxEngine struct {
+	Engine
+}
+
+type ctxQuery struct {
+	Query
+}
+
+// WithContext returns the given engine as a CtxEngine. If the engine doesn't
+// implement CtxEngine itself, each query is run in a goroutine, and
+// ctx.Err() is returned as soon as ctx is done. The abandoned query would
+// still run to completion in the background. Writes are never abandoned;
+// they only check ctx before starting, and then wait to finish. Contexts
+// which can never be done, like context.Background(), are run directly.
+func WithContext(e Engine) CtxEngine {
+	if ce, ok := e.(CtxEngine); ok {
+		return ce
+	}
+	return ctxEngine{e}
+}
+
+// QueryWithContext returns the given query as a CtxQuery, adapting it the
+// same way WithContext adapts engines.
+func QueryWithContext(q Query) CtxQuery {
+	if cq, ok := q.(CtxQuery); ok {
+		return cq
+	}
+	return ctxQuery{q}
+}
+
+func (ce ctxEngine) UpdateCtx(ctx context.Context, doc x.Doc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ce.Update(doc)
+}
+
+func (ce ctxEngine) DeleteCtx(ctx context.Context,
+	kind, id string, nanoTs int64) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ce.Delete(kind, id, nanoTs)
+}
+
+func (cq ctxQuery) RunCtx(ctx context.Context) ([]x.Doc, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return cq.Run()
+	}
+	type reply struct {
+		docs []x.Doc
+		err  error
+	}
+	ch := make(chan reply, 1)
+	go func() {
+		docs, err := cq.Run()
+		ch <- reply{docs: docs, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.docs, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cq ctxQuery) CountCtx(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if ctx.Done() == nil {
+		return cq.Count()
+	}
+	type reply struct {
+		count int64
+		err   error
+	}
+	ch := make(chan reply, 1)
+	go func() {
+		count, err := cq.Count()
+		ch <- reply{count: count, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.count, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
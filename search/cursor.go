@@ -0,0 +1,76 @@
+package search
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrInvalidCursor is returned when running a query, if the cursor passed
+// to Query.After can't be decoded.
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// cursorTime tags time.Time values within the cursor, so they're decoded
+// back as time.Time; not as strings.
+type cursorTime struct {
+	Time time.Time `json:"time"`
+}
+
+// EncodeCursor converts the sort values of a doc into an opaque cursor, to
+// be returned by Query.RunWithCursor. Engines pick the values they need to
+// resume the sort order from that doc.
+func EncodeCursor(vals []interface{}) (string, error) {
+	tagged := make([]interface{}, len(vals))
+	for i, v := range vals {
+		if t, ok := v.(time.Time); ok {
+			v = cursorTime{Time: t}
+		}
+		tagged[i] = v
+	}
+	buf, err := json.Marshal(tagged)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// DecodeCursor converts the cursor back into the sort values it was
+// generated from. Integers are returned as int64, other numbers as float64,
+// and time.Time values as they were.
+func DecodeCursor(cursor string) ([]interface{}, error) {
+	buf, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var vals []interface{}
+	if err := dec.Decode(&vals); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	for i, v := range vals {
+		if m, ok := v.(map[string]interface{}); ok {
+			s, _ := m["time"].(string)
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil || len(m) != 1 {
+				return nil, ErrInvalidCursor
+			}
+			vals[i] = t
+			continue
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if iv, err := n.Int64(); err == nil {
+			vals[i] = iv
+		} else if fv, err := n.Float64(); err == nil {
+			vals[i] = fv
+		} else {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return vals, nil
+}
@@ -0,0 +1,66 @@
+package search
+
+import (
+	"errors"
+	"sync"
+)
+
+// Types of fields, to declare via SetMapping.
+const (
+	KeywordField = iota + 1 // String matched and sorted as a whole.
+	TextField               // String analyzed for full text matching.
+	LongField
+	DoubleField
+	DateField // Milliseconds since epoch, or RFC3339 strings.
+)
+
+// Mapping holds the field types for the docs of a kind, keyed by the field
+// names within Doc.Data.
+type Mapping map[string]int
+
+// ErrInvalidFieldType is returned by SetMapping, if a field has an unknown
+// type.
+var ErrInvalidFieldType = errors.New("Invalid field type")
+
+var (
+	mmutex   sync.RWMutex
+	mappings = make(map[string]Mapping)
+)
+
+// SetMapping declares the types of the fields within the docs of the given
+// kind, for engines which support typed mappings, like ElasticSearch.
+// Fields which aren't declared are typed by the engine, as it sees them.
+// Call this before the engine's Init, typically while registering the
+// indexer for the kind. A later call for the same kind replaces the
+// earlier mapping.
+func SetMapping(kind string, m Mapping) error {
+	dup := make(Mapping)
+	for field, typ := range m {
+		if typ < KeywordField || typ > DateField {
+			log.WithField("field", field).Error("Invalid field type")
+			return ErrInvalidFieldType
+		}
+		dup[field] = typ
+	}
+
+	mmutex.Lock()
+	defer mmutex.Unlock()
+	mappings[kind] = dup
+	return nil
+}
+
+// Mappings returns all the mappings declared via SetMapping, keyed by kind.
+func Mappings() map[string]Mapping {
+	mmutex.RLock()
+	defer mmutex.RUnlock()
+
+	result := make(map[string]Mapping)
+	for kind, m := range mappings {
+		dup := make(Mapping)
+		for field, typ := range m {
+			dup[field] = typ
+		}
+		result[kind] = dup
+	}
+	return result
+}
@@ -7,10 +7,24 @@
 // application level.
 package search
 
-import "github.com/manishrjain/gocrud/x"
+import (
+	"errors"
+	"sync"
+
+	"github.com/manishrjain/gocrud/x"
+)
 
 var log = x.Log("search")
 
+// Errors returned by search and its engines, instead of bringing down the
+// whole process.
+var (
+	ErrNilEngine       = errors.New("Nil engine")
+	ErrNoEngine        = errors.New("No engine registered")
+	ErrDuplicateEngine = errors.New("Register called twice with the same name")
+	ErrTypeMismatch    = errors.New("Different types found for the same field")
+)
+
 // All the search operations are run via this Search interface.
 // Implement this interface to add support for a search engine.
 // Note that the term Entity is being used interchangeably with
@@ -20,11 +34,14 @@ var log = x.Log("search")
 // generating the right query for the engine, and then running it.
 type Query interface {
 	// NewAndFilter would return a filter which would run AND operation
-	// among individual filter queries.
+	// among individual filter queries. A query holds a single top level
+	// filter, so this replaces any filter created earlier. Use the And,
+	// Or and Not clauses of FilterQuery, to combine operations.
 	NewAndFilter() FilterQuery
 
 	// NewOrFilter would return a filter which would run OR operation
-	// among individual filter queries.
+	// among individual filter queries. Just like NewAndFilter, this replaces
+	// any filter created earlier.
 	NewOrFilter() FilterQuery
 
 	// From would set the offset from the first result. Use it along
@@ -34,18 +51,60 @@ type Query interface {
 	// Limit would limit the number of results to num.
 	Limit(num int) Query
 
-	// Order would sort the results by field in ascending order.
-	// A "-field" can be provided to sort results in descending order.
-	Order(field string) Query
+	// Order would sort the results by the fields in ascending order. A
+	// "-field" can be provided to sort results in descending order. Docs
+	// with the same value for a field are sorted by the next one, and
+	// finally by their Ids. Docs missing a field are placed after the ones
+	// having it, irrespective of the direction. Calling Order again replaces
+	// the earlier fields.
+	Order(fields ...string) Query
+
+	// After makes the query return the docs placed right after the doc the
+	// cursor was generated from, as per the sort order. The cursor should
+	// come from RunWithCursor, for a query with the same kind, filters and
+	// order. Unlike From, this stays consistent while new docs get indexed.
+	After(cursor string) Query
 
 	// Run the generated query, providing resulting documents and error, if any.
 	Run() ([]x.Doc, error)
 
+	// RunWithCursor is the same as Run, but also returns a cursor pointing to
+	// the last doc returned, to pass to After for the next page. Without any
+	// Order fields, docs are sorted by their Ids. Cursor is empty if no docs
+	// are found.
+	RunWithCursor() ([]x.Doc, string, error)
+
 	// Count the number of results that would be generated. Don't run the query.
 	Count() (int64, error)
+
+	// Aggregate computes the given aggregations over all the docs matching
+	// the query, irrespective of From, Limit and Order. Returns the results
+	// keyed by aggregation name.
+	Aggregate(aggs ...Aggregation) (map[string]AggResult, error)
 }
 
+// FilterQuery holds filters, combined via AND or OR, as per how it was
+// created. Clauses nest via And, Or and Not, to build boolean trees. For
+// e.g. (tag = cat OR tag = dog) AND NOT deleted, can be built like so:
+//
+//	f := q.NewAndFilter()
+//	f.Or().AddExact("tag", "cat").AddExact("tag", "dog")
+//	f.Not().AddExact("deleted", true)
+//
+// Empty clauses are ignored.
 type FilterQuery interface {
+	// And adds a nested clause, which matches docs satisfying all of its
+	// filters. The clause is returned back, to add filters to.
+	And() FilterQuery
+
+	// Or adds a nested clause, which matches docs satisfying any of its
+	// filters. The clause is returned back, to add filters to.
+	Or() FilterQuery
+
+	// Not adds a nested clause, which matches docs NOT satisfying all of
+	// its filters. The clause is returned back, to add filters to.
+	Not() FilterQuery
+
 	// AddExact would do exact full string, int, etc. filtering. Also called
 	// term filtering by some engines.
 	AddExact(field string, value interface{}) FilterQuery
@@ -53,6 +112,26 @@ type FilterQuery interface {
 	// AddRegex would do regular expression filtering.
 	// Naturally, requires value to be string.
 	AddRegex(field string, value string) FilterQuery
+
+	// AddRange would match values between gte and lte, both inclusive.
+	// Either of them can be nil, to leave that end of the range open.
+	// Works with numbers, strings and time.Time values.
+	AddRange(field string, gte, lte interface{}) FilterQuery
+
+	// AddPrefix would match string values starting with prefix. Engines
+	// which analyze strings match the prefix against individual terms.
+	AddPrefix(field string, prefix string) FilterQuery
+
+	// AddMatch would do full text matching, by breaking the text into
+	// terms, and matching values containing any of those terms.
+	AddMatch(field string, text string) FilterQuery
+
+	// AddExists would match docs which have a non-null value for field.
+	AddExists(field string) FilterQuery
+
+	// AddMissing would match docs which have no value, or a null value
+	// for field.
+	AddMissing(field string) FilterQuery
 }
 
 // Engine provides the interface to be implemented to support search engines.
@@ -66,6 +145,15 @@ type Engine interface {
 	// overwriting a newer doc by an older doc.
 	Update(x.Doc) error
 
+	// Delete removes the doc from index, unless the index already has the
+	// same or a newer version of it, as per nanoTs. Just like Update, this
+	// should be versioned, so an older version of the doc doesn't get
+	// indexed again after deletion. Deleting a missing doc isn't an error.
+	// Engines may only retain the version of a deleted doc for a while;
+	// ElasticSearch forgets it after index.gc_deletes, 60s by default, and
+	// then accepts older versions again. Memsearch and bleve retain it.
+	Delete(kind, id string, nanoTs int64) error
+
 	// NewQuery creates the query encapsulator, restricting results by given kind.
 	NewQuery(kind string) Query
 }
@@ -75,26 +163,65 @@ type Engine interface {
 // Where("field >", "something") or
 // Where("field <", "something")
 
-var dengine Engine
-
-func Register(name string, driver Engine) {
+var (
+	mutex    sync.RWMutex
+	engines  = make(map[string]Engine)
+	fallback string // Name of the default engine.
+)
+
+// Register adds the search engine under the given name. The first engine
+// registered becomes the default one, returned by Get. Returns ErrNilEngine
+// if driver is nil, and ErrDuplicateEngine if the name is already taken.
+func Register(name string, driver Engine) error {
+	mutex.Lock()
+	defer mutex.Unlock()
 	if driver == nil {
-		log.WithField("search", name).Fatal("nil engine")
-		return
+		log.WithField("search", name).Error("nil engine")
+		return ErrNilEngine
 	}
-	if dengine != nil {
-		log.WithField("search", name).Fatal("Register called twice")
-		return
+	if _, dup := engines[name]; dup {
+		log.WithField("search", name).Error("Register called twice")
+		return ErrDuplicateEngine
 	}
 
 	log.WithField("search", name).Debug("Registering search engine")
-	dengine = driver
+	engines[name] = driver
+	if len(fallback) == 0 {
+		fallback = name
+	}
+	return nil
 }
 
+// SetDefault makes the engine registered under name the default one.
+// Returns ErrNoEngine if no such engine exists.
+func SetDefault(name string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, present := engines[name]; !present {
+		log.WithField("search", name).Error("No engine registered")
+		return ErrNoEngine
+	}
+	fallback = name
+	return nil
+}
+
+// Get returns the default search engine, or nil if there's none.
 func Get() Engine {
-	if dengine == nil {
-		log.Fatal("No engine registered")
+	return GetNamed("")
+}
+
+// GetNamed returns the search engine registered under the given name,
+// or nil if there's none. An empty name refers to the default engine.
+func GetNamed(name string) Engine {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if len(name) == 0 {
+		name = fallback
+	}
+	engine, present := engines[name]
+	if !present {
+		log.WithField("search", name).Error("No engine registered")
 		return nil
 	}
-	return dengine
+	return engine
 }
@@ -0,0 +1,60 @@
+package store
+
+import (
+	"context"
+
+	"github.com/manishrjain/gocrud/req"
+	"github.com/manishrjain/gocrud/x"
+)
+
+// Batch collects multiple Update trees, possibly rooted at unrelated
+// entities, so they can all be committed together. For e.g. decrementing
+// credits of one user, and crediting them to another.
+type Batch struct {
+	roots []*Update
+}
+
+// NewBatch returns back an empty Batch, to add Updates to.
+func NewBatch() *Batch {
+	return new(Batch)
+}
+
+// Add finds the root from the given Update pointer, and adds that tree
+// to the batch. Adding the same tree more than once has no effect.
+func (b *Batch) Add(u *Update) *Batch {
+	u = u.root()
+	for _, r := range b.roots {
+		if r == u {
+			return b
+		}
+	}
+	b.roots = append(b.roots, u)
+	return b
+}
+
+// Execute generates the instructions for all the Update trees in the batch,
+// and commits them via a single call to Store.Commit. So, the batch is
+// atomic if the underlying store driver writes a Commit atomically.
+// Indexer is notified of the modified entities only after the commit
+// succeeds.
+func (b *Batch) Execute(c *req.Context) error {
+	return b.ExecuteCtx(context.Background(), c)
+}
+
+// ExecuteCtx is the same as Execute, but stops reading the store and
+// returns ctx.Err() as soon as ctx is cancelled, or its deadline is exceeded.
+// Once the commit starts, it isn't abandoned; so if an error is returned,
+// nothing has been written.
+func (b *Batch) ExecuteCtx(ctx context.Context, c *req.Context) error {
+	if c.NumCharsUnique <= 0 {
+		return ErrInvalidNumChars
+	}
+
+	var its []*x.Instruction
+	for _, u := range b.roots {
+		if err := u.doExecute(ctx, c, &its); err != nil {
+			return err
+		}
+	}
+	return commit(ctx, c, b.roots, its)
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+
+	"github.com/manishrjain/gocrud/x"
+)
+
+// CtxStore is implemented by store drivers which natively support
+// cancellation and deadlines via context.Context. Drivers which don't,
+// can be adapted via WithContext.
+type CtxStore interface {
+	Store
+
+	// CommitCtx is the same as Commit, but returns ctx.Err() without
+	// writing anything, if ctx is already done. Once started, a commit is
+	// never abandoned, so if it returns an error, the instructions haven't
+	// been written, and won't get written later either.
+	CommitCtx(ctx context.Context, its []*x.Instruction) error
+
+	// IsNewCtx is the same as IsNew, but may return ctx.Err() as soon as
+	// ctx is done.
+	IsNewCtx(ctx context.Context, entityId string) (bool, error)
+
+	// GetEntityCtx is the same as GetEntity, but may return ctx.Err() as
+	// soon as ctx is done.
+	GetEntityCtx(ctx context.Context, entityId string) ([]x.Instruction, error)
+
+	// IterateCtx is the same as Iterate, but may return ctx.Err() as soon
+	// as ctx is done.
+	IterateCtx(ctx context.Context, fromId string, num int,
+		ch chan x.Entity) (int, x.Entity, error)
+}
+
+// ctxStore adapts a Store to CtxStore, by running each read in a separate
+// goroutine, and returning early if the context is done.
+type ctxStore struct {
+	Store
+}
+
+// WithContext returns the given store as a CtxStore. If the driver doesn't
+// implement CtxStore itself, each read is run in a goroutine, and ctx.Err()
+// is returned as soon as ctx is done. The abandoned read would still run to
+// completion in the background. Writes are never abandoned; CommitCtx only
+// checks ctx before starting the commit, and then waits for it to finish.
+// Contexts which can never be done, like context.Background(), are run
+// directly.
+func WithContext(s Store) CtxStore {
+	if cs, ok := s.(CtxStore); ok {
+		return cs
+	}
+	return ctxStore{s}
+}
+
+// CommitCtx doesn't return before Commit does, so the caller never sees
+// an error for instructions which might still get written.
+func (cs ctxStore) CommitCtx(ctx context.Context, its []*x.Instruction) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cs.Commit(its)
+}
+
+func (cs ctxStore) IsNewCtx(ctx context.Context, entityId string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if ctx.Done() == nil {
+		return cs.IsNew(entityId), nil
+	}
+	ch := make(chan bool, 1)
+	go func() {
+		ch <- cs.IsNew(entityId)
+	}()
+	select {
+	case isnew := <-ch:
+		return isnew, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (cs ctxStore) GetEntityCtx(ctx context.Context,
+	entityId string) ([]x.Instruction, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return cs.GetEntity(entityId)
+	}
+	type reply struct {
+		its []x.Instruction
+		err error
+	}
+	ch := make(chan reply, 1)
+	go func() {
+		its, err := cs.GetEntity(entityId)
+		ch <- reply{its: its, err: err}
+	}()
+	select {
+	case r := <-ch:
+		return r.its, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (cs ctxStore) IterateCtx(ctx context.Context, fromId string, num int,
+	ch chan x.Entity) (int, x.Entity, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, x.Entity{}, err
+	}
+	if ctx.Done() == nil {
+		return cs.Iterate(fromId, num, ch)
+	}
+	type reply struct {
+		num  int
+		last x.Entity
+		err  error
+	}
+	rch := make(chan reply, 1)
+	go func() {
+		num, last, err := cs.Iterate(fromId, num, ch)
+		rch <- reply{num: num, last: last, err: err}
+	}()
+	select {
+	case r := <-rch:
+		return r.num, r.last, r.err
+	case <-ctx.Done():
+		return 0, x.Entity{}, ctx.Err()
+	}
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/manishrjain/gocrud/x"
+)
+
+// Change stores the modification of a single predicate by a commit.
+// Old would be an empty Object if the predicate was set for the first time.
+// Edge is set for edges added to other entities, including children and
+// parents; New.Value then holds the id of the target entity. Edges can only
+// be added, so Old is always empty for them.
+type Change struct {
+	Predicate string
+	Old       Object
+	New       Object
+	Edge      bool
+}
+
+// Revision stores all the changes made to an entity by a single commit,
+// along with the commit timestamp and the author of the commit.
+type Revision struct {
+	NanoTs  int64
+	Source  string
+	Changes []Change
+}
+
+// byCommit sorts instructions by timestamp, and then by source and
+// predicate, so changes made by a single commit stay together.
+type byCommit []x.Instruction
+
+func (b byCommit) Len() int      { return len(b) }
+func (b byCommit) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCommit) Less(i, j int) bool {
+	if b[i].NanoTs != b[j].NanoTs {
+		return b[i].NanoTs < b[j].NanoTs
+	}
+	if b[i].Source != b[j].Source {
+		return b[i].Source < b[j].Source
+	}
+	return b[i].Predicate < b[j].Predicate
+}
+
+// History retrieves the changelog for the given entity id, as a list of
+// revisions sorted by commit timestamp, oldest first. Both properties and
+// edges are tracked, including the ones to child and parent entities.
+// Note that _delete_ is a property, so deletions would show up as well.
+// The default store driver is used.
+func History(entityId string) ([]Revision, error) {
+	return HistoryNamed("", entityId)
+}
+
+// HistoryNamed works like History, using the store driver registered
+// under the given name.
+func HistoryNamed(name, entityId string) ([]Revision, error) {
+	s, err := getNamedCtx(name)
+	if err != nil {
+		return nil, err
+	}
+	its, err := s.GetEntity(entityId)
+	if err != nil {
+		x.LogErr(log, err).WithField("id", entityId).Error("While retrieving entity")
+		return nil, err
+	}
+	sort.Sort(byCommit(its))
+
+	var revs []Revision
+	columns := make(map[string]*Versions)
+	for _, it := range its {
+		o := Object{NanoTs: it.NanoTs, Source: it.Source}
+		var c Change
+		if len(it.ObjectId) > 0 {
+			o.Value = it.ObjectId
+			c = Change{Predicate: it.Predicate, New: o, Edge: true}
+		} else {
+			if err := json.Unmarshal(it.Object, &o.Value); err != nil {
+				x.LogErr(log, err).Error("While unmarshal")
+				return nil, err
+			}
+			versions, present := columns[it.Predicate]
+			if !present {
+				versions = new(Versions)
+				columns[it.Predicate] = versions
+			}
+			c = Change{Predicate: it.Predicate, Old: versions.Latest(), New: o}
+			if err := versions.add(o); err != nil {
+				return nil, err
+			}
+		}
+
+		last := len(revs) - 1
+		if last < 0 || revs[last].NanoTs != it.NanoTs ||
+			revs[last].Source != it.Source {
+			revs = append(revs, Revision{NanoTs: it.NanoTs, Source: it.Source})
+			last += 1
+		}
+		revs[last].Changes = append(revs[last].Changes, c)
+	}
+	return revs, nil
+}
@@ -0,0 +1,44 @@
+package store
+
+import "errors"
+
+// ErrUnsortedMigrations is returned by RunMigrations if the migration
+// versions aren't strictly increasing.
+var ErrUnsortedMigrations = errors.New("Migrations should have strictly increasing versions")
+
+// Migration is a single schema change for a store driver. Drivers keep an
+// ordered list of these, and append to it whenever their schema changes.
+// Versions start from 1; version 0 denotes an empty database.
+type Migration struct {
+	Version int
+	Apply   func() error
+}
+
+// RunMigrations applies all the migrations with version greater than
+// current, in order. After each successful migration, setVersion is called
+// to record the new schema version, so an interrupted run resumes from
+// where it stopped. Returns the schema version reached, and error, if any.
+func RunMigrations(current int, migrations []Migration,
+	setVersion func(version int) error) (int, error) {
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			return current, ErrUnsortedMigrations
+		}
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		log.WithField("version", m.Version).Info("Applying migration")
+		if err := m.Apply(); err != nil {
+			return current, err
+		}
+		if err := setVersion(m.Version); err != nil {
+			return current, err
+		}
+		current = m.Version
+	}
+	return current, nil
+}
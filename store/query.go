@@ -1,12 +1,14 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"sort"
 	"time"
 
+	"github.com/manishrjain/gocrud/req"
 	"github.com/manishrjain/gocrud/x"
 )
 
@@ -24,6 +26,8 @@ type Query struct {
 	children   []*Query
 	parent     *Query
 	getDeleted bool
+	asOf       int64
+	c          *req.Context
 }
 
 type Object struct {
@@ -32,6 +36,15 @@ type Object struct {
 	NanoTs int64
 }
 
+// toMap converts the Object to the format used by ToMapWithVersions.
+func (o Object) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"value":  o.Value,
+		"source": o.Source,
+		"ts":     o.NanoTs,
+	}
+}
+
 type Versions struct {
 	versions []Object
 }
@@ -50,15 +63,17 @@ type runResult struct {
 	Err    error
 }
 
-func (v *Versions) add(o Object) {
+func (v *Versions) add(o Object) error {
 	if len(v.versions) > 0 {
 		i := len(v.versions) - 1
 		if v.versions[i].NanoTs > o.NanoTs {
 			// unsorted list. Gocrud code is doing something wrong.
-			log.Fatal("Appending an object with lower ts to a sorted list")
+			log.Error("Appending an object with lower ts to a sorted list")
+			return ErrUnsortedVersions
 		}
 	}
 	v.versions = append(v.versions, o)
+	return nil
 }
 
 func (v Versions) Latest() Object {
@@ -80,10 +95,52 @@ func (v Versions) Count() int {
 	return len(v.versions)
 }
 
+// All returns a copy of all the versions, sorted by timestamp, oldest first.
+func (v Versions) All() []Object {
+	all := make([]Object, len(v.versions))
+	copy(all, v.versions)
+	return all
+}
+
+// At returns the version which was in effect at the given timestamp, i.e.
+// the latest version with timestamp lesser than or equal to nanoTs.
+// Returns an empty Object, if no such version exists.
+func (v Versions) At(nanoTs int64) Object {
+	i := sort.Search(len(v.versions), func(i int) bool {
+		return v.versions[i].NanoTs > nanoTs
+	})
+	if i == 0 {
+		return Object{}
+	}
+	return v.versions[i-1]
+}
+
+// Since returns all the versions with timestamp greater than nanoTs,
+// sorted by timestamp, oldest first.
+func (v Versions) Since(nanoTs int64) []Object {
+	i := sort.Search(len(v.versions), func(i int) bool {
+		return v.versions[i].NanoTs > nanoTs
+	})
+	since := make([]Object, len(v.versions)-i)
+	copy(since, v.versions[i:])
+	return since
+}
+
 // Parent retrieves the parent id for given entity id. Return ErrNoParent if parent is
 // not present. Otherwise, if an error occurs during retrieval, returns that.
+// The default store driver is used.
 func Parent(id string) (parentid string, rerr error) {
-	its, err := Get().GetEntity(id)
+	return ParentNamed("", id)
+}
+
+// ParentNamed works like Parent, using the store driver registered under
+// the given name.
+func ParentNamed(name, id string) (parentid string, rerr error) {
+	s, err := getNamedCtx(name)
+	if err != nil {
+		return "", err
+	}
+	its, err := s.GetEntity(id)
 	if err != nil {
 		x.LogErr(log, err).WithField("id", id).Error("While retrieving entity")
 		return "", err
@@ -123,8 +180,27 @@ func (q *Query) AllowDeleted() *Query {
 	return q
 }
 
-// Collect specifies the kind of child entities to retrieve. Returns back
-// a new Query pointer pointing to those children entities as a collective.
+// SetContext sets the request context for the query. Currently, this is
+// used to pick the store driver to run the query against, via c.Store.
+// Like Run, it applies to the whole query, from its root.
+func (q *Query) SetContext(c *req.Context) *Query {
+	q.root().c = c
+	return q
+}
+
+// AsOf restricts the query to instructions committed at or before nanoTs,
+// so Run would return the entity tree as it existed at that moment.
+// Newer property values, children and _delete_ markers are ignored.
+// This is possible because of the retention principle; nothing ever gets
+// overwritten. The timestamp provided should be in nano-seconds.
+func (q *Query) AsOf(nanoTs int64) *Query {
+	q.asOf = nanoTs
+	return q
+}
+
+// Collect specifies the kind of child entities to retrieve, or the predicate
+// of edges added via Update.AddEdge. Returns back a new Query pointer
+// pointing to those children entities as a collective.
 //
 // Any further operations on this returned pointer would attribute to those
 // children entities, and not the caller query entity.
@@ -138,6 +214,7 @@ func (q *Query) Collect(kind string) *Query {
 	child.parent = q
 	child.kind = kind
 	child.getDeleted = q.getDeleted
+	child.asOf = q.asOf
 	q.children = append(q.children, child)
 	return child
 }
@@ -159,16 +236,41 @@ func (q *Query) root() *Query {
 	return q
 }
 
-func (q *Query) doRun(level, max int, ch chan runResult) {
+// filterAsOf drops all the instructions committed after q.asOf.
+func (q *Query) filterAsOf(its []x.Instruction) []x.Instruction {
+	filtered := its[:0]
+	for _, it := range its {
+		if it.NanoTs <= q.asOf {
+			filtered = append(filtered, it)
+		}
+	}
+	return filtered
+}
+
+// send passes the result to ch, unless ctx is done before anyone
+// is ready to receive it.
+func send(ctx context.Context, ch chan runResult, rr runResult) {
+	select {
+	case ch <- rr:
+	case <-ctx.Done():
+	}
+}
+
+func (q *Query) doRun(ctx context.Context, s CtxStore, level, max int,
+	ch chan runResult) {
+
 	log.Debugf("Query: %+v", q)
-	its, err := Get().GetEntity(q.id)
+	its, err := s.GetEntityCtx(ctx, q.id)
 	if err != nil {
 		x.LogErr(log, err).Error("While retrieving: ", q.id)
-		ch <- runResult{Result: nil, Err: err}
+		send(ctx, ch, runResult{Result: nil, Err: err})
 		return
 	}
+	if q.asOf > 0 {
+		its = q.filterAsOf(its)
+	}
 	if len(its) == 0 {
-		ch <- runResult{Result: new(Result), Err: nil}
+		send(ctx, ch, runResult{Result: new(Result), Err: nil})
 		return
 	}
 	sort.Sort(x.Its(its))
@@ -195,7 +297,7 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 				WithField("kind", result.Kind).
 				WithField("_delete_", true).
 				Debug("Discarding due to delete bit")
-			ch <- runResult{Result: new(Result), Err: nil}
+			send(ctx, ch, runResult{Result: new(Result), Err: nil})
 			return
 		}
 
@@ -212,7 +314,7 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 				WithField("kind", result.Kind).
 				WithField("predicate", it.Predicate).
 				Debug("Discarding due to predicate filter")
-			ch <- runResult{Result: new(Result), Err: nil}
+			send(ctx, ch, runResult{Result: new(Result), Err: nil})
 			return
 		}
 
@@ -220,14 +322,17 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 			o := Object{NanoTs: it.NanoTs, Source: it.Source}
 			if err := json.Unmarshal(it.Object, &o.Value); err != nil {
 				x.LogErr(log, err).Error("While unmarshal")
-				ch <- runResult{Result: nil, Err: err}
+				send(ctx, ch, runResult{Result: nil, Err: err})
 				return
 			}
 
 			if _, vok := result.Columns[it.Predicate]; !vok {
 				result.Columns[it.Predicate] = new(Versions)
 			}
-			result.Columns[it.Predicate].add(o)
+			if err := result.Columns[it.Predicate].add(o); err != nil {
+				send(ctx, ch, runResult{Result: nil, Err: err})
+				return
+			}
 			continue
 		}
 
@@ -236,12 +341,13 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 			*nchildq = *childq // This is important, otherwise id gets overwritten
 			nchildq.id = it.ObjectId
 			nchildq.getDeleted = q.getDeleted
+			nchildq.asOf = q.asOf
 
 			// Use child's maxDepth here, instead of parent's.
 			waitTimes += 1
 			log.WithField("child_id", nchildq.id).
 				WithField("child_kind", nchildq.kind).Debug("Go routine for child")
-			go nchildq.doRun(0, nchildq.maxDepth, childChan)
+			go nchildq.doRun(ctx, s, 0, nchildq.maxDepth, childChan)
 			continue
 		}
 
@@ -249,21 +355,28 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 			child := new(Query)
 			child.id = it.ObjectId
 			child.getDeleted = q.getDeleted
+			child.asOf = q.asOf
 
 			waitTimes += 1
 			log.WithField("child_id", child.id).WithField("level", level+1).
 				Debug("Go routine for child one level deeper")
-			go child.doRun(level+1, max, childChan)
+			go child.doRun(ctx, s, level+1, max, childChan)
 		}
 	}
 
 	// Wait for all those subroutines
 	for i := 0; i < waitTimes; i++ {
 		log.Debugf("Waiting for children subroutines: %v/%v", i, waitTimes-1)
-		rr := <-childChan
+		var rr runResult
+		select {
+		case rr = <-childChan:
+		case <-ctx.Done():
+			send(ctx, ch, runResult{Result: nil, Err: ctx.Err()})
+			return
+		}
 		log.Debugf("Waiting done")
 		if rr.Err != nil {
-			x.LogErr(log, err).Error("While child doRun")
+			x.LogErr(log, rr.Err).Error("While child doRun")
 		} else {
 			if len(rr.Result.Id) > 0 && len(rr.Result.Kind) > 0 {
 				log.WithField("result", *rr.Result).Debug("Appending child")
@@ -272,23 +385,116 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 		}
 	}
 
-	ch <- runResult{Result: result, Err: nil}
+	send(ctx, ch, runResult{Result: result, Err: nil})
 	return
 }
 
+// Incoming returns the entities which have an edge via predicate, pointing
+// to the entity this Query points to. For e.g. Likes on a Post, or Users
+// following a User. An empty predicate would match all edges. Entities
+// marked as deleted are skipped, unless AllowDeleted is set; AsOf is
+// respected as well.
+//
+// This requires the store driver to implement ReverseIndex. Returns
+// ErrNotImplemented otherwise.
+func (q *Query) Incoming(predicate string) ([]x.Entity, error) {
+	if len(q.id) == 0 {
+		return nil, errors.New("Empty entity id")
+	}
+	s, err := get(q.root().c)
+	if err != nil {
+		return nil, err
+	}
+	ri, ok := s.(ReverseIndex)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	its, err := ri.GetIncoming(q.id)
+	if err != nil {
+		x.LogErr(log, err).WithField("id", q.id).Error("While retrieving incoming")
+		return nil, err
+	}
+	if q.asOf > 0 {
+		its = q.filterAsOf(its)
+	}
+	sort.Sort(x.Its(its))
+
+	var result []x.Entity
+	found := make(map[x.Entity]bool)
+	for _, it := range its {
+		if it.ObjectId != q.id {
+			continue
+		}
+		if len(predicate) > 0 && it.Predicate != predicate {
+			continue
+		}
+		e := x.Entity{Kind: it.SubjectType, Id: it.SubjectId}
+		if _, present := found[e]; present {
+			continue
+		}
+		found[e] = true
+		if !q.getDeleted {
+			deleted, err := q.isDeleted(s, e.Id)
+			if err != nil {
+				return nil, err
+			}
+			if deleted {
+				continue
+			}
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// isDeleted returns true if the given entity has been marked deleted,
+// at the time q.asOf if set.
+func (q *Query) isDeleted(s Store, id string) (bool, error) {
+	its, err := s.GetEntity(id)
+	if err != nil {
+		x.LogErr(log, err).WithField("id", id).Error("While retrieving entity")
+		return false, err
+	}
+	if q.asOf > 0 {
+		its = q.filterAsOf(its)
+	}
+	for _, it := range its {
+		if it.Predicate == "_delete_" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // Run finds the root from the given Query pointer, recursively executes
 // the read operations, and returns back pointer to Result object.
 // Any errors encountered during these stpeps is returned as well.
 func (q *Query) Run() (result *Result, rerr error) {
+	return q.RunCtx(context.Background())
+}
+
+// RunCtx is the same as Run, but stops retrieving entities and returns
+// ctx.Err() as soon as ctx is cancelled, or its deadline is exceeded.
+// Cancellation is passed through to the goroutines retrieving children.
+func (q *Query) RunCtx(ctx context.Context) (result *Result, rerr error) {
 	q = q.root()
 	if len(q.id) == 0 {
 		return result, errors.New("Empty entity id")
 	}
 
+	s, err := getCtx(q.c)
+	if err != nil {
+		return result, err
+	}
+
 	ch := make(chan runResult)
-	go q.doRun(0, q.maxDepth, ch)
-	rr := <-ch // Blocking wait
-	return rr.Result, rr.Err
+	go q.doRun(ctx, s, 0, q.maxDepth, ch)
+	select {
+	case rr := <-ch:
+		return rr.Result, rr.Err
+	case <-ctx.Done():
+		return result, ctx.Err()
+	}
 }
 
 func (r *Result) Drop(pred string) {
@@ -302,7 +508,22 @@ func (r *Result) Debug(level int) {
 	}
 }
 
-func (r *Result) ToMap() (data map[string]interface{}) {
+// ToMap converts the Result to a map, keeping only the latest value
+// of each predicate.
+func (r *Result) ToMap() map[string]interface{} {
+	return r.toMap(false)
+}
+
+// ToMapWithVersions converts the Result to a map, like ToMap. But instead
+// of the latest value, each predicate holds the list of all its versions,
+// in this format:
+//
+//  [{"value": ..., "source": ..., "ts": ...}, ...]
+func (r *Result) ToMapWithVersions() map[string]interface{} {
+	return r.toMap(true)
+}
+
+func (r *Result) toMap(allVersions bool) (data map[string]interface{}) {
 	data = make(map[string]interface{})
 	data["id"] = r.Id
 	data["kind"] = r.Kind
@@ -312,8 +533,16 @@ func (r *Result) ToMap() (data map[string]interface{}) {
 		// During conversion to JSON, to keep things simple,
 		// we're dropping older versions of predicates, and
 		// source and ts information across all the predicates,
-		// keeping only the latest one.
-		data[pred] = versions.Latest().Value
+		// keeping only the latest one. Unless asked for all versions.
+		if allVersions {
+			var l []map[string]interface{}
+			for _, o := range versions.All() {
+				l = append(l, o.toMap())
+			}
+			data[pred] = l
+		} else {
+			data[pred] = versions.Latest().Value
+		}
 		if versions.Latest().NanoTs > ts_latest {
 			ts_latest = versions.Latest().NanoTs
 			data["modifier"] = versions.Latest().Source // Loss of information.
@@ -336,7 +565,7 @@ func (r *Result) ToMap() (data map[string]interface{}) {
 			if kind != child.Kind {
 				continue
 			}
-			l = append(l, child.ToMap())
+			l = append(l, child.toMap(allVersions))
 		}
 		data[kind] = l
 	}
@@ -353,6 +582,13 @@ func (r *Result) ToJson() ([]byte, error) {
 	return json.Marshal(data)
 }
 
+// ToJsonWithVersions creates the JSON for the data pointed by the Result
+// pointer, outputting all versions of each predicate. See ToMapWithVersions.
+func (r *Result) ToJsonWithVersions() ([]byte, error) {
+	data := r.ToMapWithVersions()
+	return json.Marshal(data)
+}
+
 // WriteJsonResponse does the same as ToJson. But also writes the JSON
 // generated to http.ResponseWriter. In case of error, writes that error
 // instead, in this format:
@@ -4,18 +4,36 @@
 package store
 
 import (
+	"errors"
+	"sync"
+
+	"github.com/manishrjain/gocrud/req"
 	"github.com/manishrjain/gocrud/x"
 )
 
 var log = x.Log("store")
 
+// Errors returned by store and its drivers, instead of bringing down the
+// whole process.
+var (
+	ErrNilDriver        = errors.New("Nil store")
+	ErrDuplicateDriver  = errors.New("Register called twice with the same name")
+	ErrNoDriver         = errors.New("No driver registered")
+	ErrNotImplemented   = errors.New("Not implemented")
+	ErrUnsortedVersions = errors.New("Appending an object with lower ts to a sorted list")
+	ErrNonEmptyChildId  = errors.New("Child id should be empty for all current use cases")
+	ErrInvalidNumChars  = errors.New("Invalid req.Context.NumCharsUnique")
+)
+
 // All the data CRUD operations are run via this Store interface.
 // Implement this interface to add support for a datastore.
 type Store interface {
 	// Init is used to initialize store driver.
 	Init(args ...string)
 
-	// Commit writes the array of instructions to the data store.
+	// Commit writes the array of instructions to the data store. If the data
+	// store supports it, all the instructions should be written atomically;
+	// store.Batch relies on this to update multiple entities together.
 	Commit(its []*x.Instruction) error
 
 	// IsNew returns true if the entity id provided doesn't exist in the
@@ -39,25 +57,102 @@ type Store interface {
 	Iterate(fromId string, num int, ch chan x.Entity) (int, x.Entity, error)
 }
 
-var driver Store
+// ReverseIndex is optionally implemented by store drivers which maintain an
+// index over object ids, to find the entities pointing to a given entity
+// without scanning over the whole table. Query.Incoming relies on it.
+type ReverseIndex interface {
+	// GetIncoming retrieves all the rows with the given object id, parses
+	// them into instructions, and returns them.
+	GetIncoming(objectId string) ([]x.Instruction, error)
+}
+
+var (
+	mutex    sync.RWMutex
+	drivers  = make(map[string]Store)
+	fallback string // Name of the default driver.
+)
 
-func Register(name string, store Store) {
+// Register adds the store driver under the given name. The first driver
+// registered becomes the default one, returned by Get. Returns ErrNilDriver
+// if store is nil, and ErrDuplicateDriver if the name is already taken.
+func Register(name string, store Store) error {
+	mutex.Lock()
+	defer mutex.Unlock()
 	if store == nil {
-		log.WithField("driver", name).Fatal("Nil store")
-		return
+		log.WithField("driver", name).Error("Nil store")
+		return ErrNilDriver
 	}
-	if driver != nil {
-		log.WithField("driver", name).Fatal("Register called twice")
-		return
+	if _, dup := drivers[name]; dup {
+		log.WithField("driver", name).Error("Register called twice")
+		return ErrDuplicateDriver
 	}
 	log.WithField("driver", name).Debug("Registering store driver")
-	driver = store
+	drivers[name] = store
+	if len(fallback) == 0 {
+		fallback = name
+	}
+	return nil
+}
+
+// SetDefault makes the driver registered under name the default one.
+// Returns ErrNoDriver if no such driver exists.
+func SetDefault(name string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, present := drivers[name]; !present {
+		log.WithField("driver", name).Error("No driver registered")
+		return ErrNoDriver
+	}
+	fallback = name
+	return nil
 }
 
+// Get returns the default store driver, or nil if there's none.
 func Get() Store {
-	if driver == nil {
-		log.Fatal("No driver registered")
+	return GetNamed("")
+}
+
+// GetNamed returns the store driver registered under the given name,
+// or nil if there's none. An empty name refers to the default driver.
+func GetNamed(name string) Store {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if len(name) == 0 {
+		name = fallback
+	}
+	driver, present := drivers[name]
+	if !present {
+		log.WithField("driver", name).Error("No driver registered")
 		return nil
 	}
 	return driver
 }
+
+// getCtx returns the store driver picked by c as a CtxStore, or
+// ErrNoDriver if there's none. A nil c refers to the default driver.
+func getCtx(c *req.Context) (CtxStore, error) {
+	driver, err := get(c)
+	if err != nil {
+		return nil, err
+	}
+	return WithContext(driver), nil
+}
+
+// getNamedCtx returns the store driver registered under name as a
+// CtxStore, or ErrNoDriver if there's none.
+func getNamedCtx(name string) (CtxStore, error) {
+	return getCtx(&req.Context{Store: name})
+}
+
+// get returns the store driver picked by c, or ErrNoDriver if there's none.
+func get(c *req.Context) (Store, error) {
+	var name string
+	if c != nil {
+		name = c.Store
+	}
+	driver := GetNamed(name)
+	if driver == nil {
+		return nil, ErrNoDriver
+	}
+	return driver, nil
+}
@@ -1,9 +1,11 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -11,6 +13,24 @@ import (
 	"github.com/manishrjain/gocrud/x"
 )
 
+var (
+	ErrConflict = errors.New("Entity modified after the expected version")
+
+	// commitMu guards conditional updates against concurrent commits from
+	// within the same process. Conditional commits hold the write lock,
+	// while all the other commits hold the read lock.
+	commitMu sync.RWMutex
+)
+
+// link stores a directed relationship to an existing entity, along with
+// the predicate for the optional relationship back from it.
+type link struct {
+	predicate string
+	kind      string
+	id        string
+	reverse   string
+}
+
 // Update stores the create and update instructions, acting as the modifier
 // to the entity Update relates to.
 type Update struct {
@@ -18,9 +38,12 @@ type Update struct {
 	id       string
 	source   string
 	children []*Update
+	links    []link
 	parent   *Update
 	edges    map[string]interface{}
 	NanoTs   int64
+
+	unchangedSince int64
 }
 
 // NewUpdate is the main entrypoint to updates. Returns back a Update
@@ -64,6 +87,30 @@ func (n *Update) AddChild(kind string) *Update {
 	return child
 }
 
+// AddEdge creates a directed relationship via predicate, from the current
+// entity to an already existing entity with the given kind and id. For e.g.
+// User A follows User B, or Post tagged with Tag T. The target entity isn't
+// modified, and its existence isn't checked.
+//
+// Query.Collect(predicate) and Query.UptoDepth would follow these edges,
+// the same way they follow edges to children.
+func (n *Update) AddEdge(predicate, kind, id string) *Update {
+	log.WithField("predicate", predicate).WithField("id", id).Debug("AddEdge")
+	n.links = append(n.links, link{predicate: predicate, kind: kind, id: id})
+	return n
+}
+
+// AddEdgeWithReverse does the same as AddEdge, but also creates
+// a relationship back from the target entity to the current entity via
+// the reverse predicate. For e.g. "follows" and "followed_by".
+func (n *Update) AddEdgeWithReverse(predicate, reverse, kind, id string) *Update {
+	log.WithField("predicate", predicate).WithField("reverse", reverse).
+		WithField("id", id).Debug("AddEdgeWithReverse")
+	n.links = append(n.links, link{predicate: predicate, kind: kind, id: id,
+		reverse: reverse})
+	return n
+}
+
 // Set allows you to set the property and value on the current entity.
 // This would effectively replace any other value this property had,
 // on this entity node pointer represents.
@@ -86,6 +133,85 @@ func (n *Update) MarkDeleted() *Update {
 	return n.Set("_delete_", true)
 }
 
+// IfUnchangedSince makes Execute fail with ErrConflict, if the entity
+// this Update points to got any instructions committed after nanoTs.
+// Typically, nanoTs would be the version of the entity, as retrieved
+// via Version when the entity was read.
+//
+// The check and the commit are atomic only within this process. Whether
+// concurrent writers from other processes are detected, depends upon
+// the store driver. Check the driver documentation.
+func (n *Update) IfUnchangedSince(nanoTs int64) *Update {
+	n.unchangedSince = nanoTs
+	return n
+}
+
+// Version returns the timestamp of the latest instruction committed for
+// the given entity id, or zero if the entity doesn't exist.
+// The default store driver is used.
+func Version(entityId string) (int64, error) {
+	return VersionNamed("", entityId)
+}
+
+// VersionNamed works like Version, using the store driver registered under
+// the given name.
+func VersionNamed(name, entityId string) (int64, error) {
+	s, err := getNamedCtx(name)
+	if err != nil {
+		return 0, err
+	}
+	return version(context.Background(), s, entityId)
+}
+
+func version(ctx context.Context, s CtxStore, entityId string) (int64, error) {
+	its, err := s.GetEntityCtx(ctx, entityId)
+	if err != nil {
+		x.LogErr(log, err).WithField("id", entityId).Error("While retrieving entity")
+		return 0, err
+	}
+	var latest int64
+	for _, it := range its {
+		if it.NanoTs > latest {
+			latest = it.NanoTs
+		}
+	}
+	return latest, nil
+}
+
+func (n *Update) isConditional() bool {
+	if n.unchangedSince > 0 {
+		return true
+	}
+	for _, child := range n.children {
+		if child.isConditional() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVersions returns ErrConflict if any entity in the tree has been
+// modified after the version expected via IfUnchangedSince.
+func (n *Update) checkVersions(ctx context.Context, s CtxStore) error {
+	if n.unchangedSince > 0 && len(n.id) > 0 {
+		latest, err := version(ctx, s, n.id)
+		if err != nil {
+			return err
+		}
+		if latest > n.unchangedSince {
+			log.WithField("id", n.id).WithField("expected", n.unchangedSince).
+				WithField("found", latest).Debug("Version conflict")
+			return ErrConflict
+		}
+	}
+	for _, child := range n.children {
+		if err := child.checkVersions(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (n *Update) recPrint(l int) {
 	log.Printf("Update[%d]: %+v", l, n)
 	for _, child := range n.children {
@@ -131,7 +257,8 @@ func (n *Update) SetCommitTs(tsNano int64) *Update {
 	return n
 }
 
-func (n *Update) doExecute(c *req.Context, its *[]*x.Instruction) error {
+func (n *Update) doExecute(ctx context.Context, c *req.Context,
+	its *[]*x.Instruction) error {
 	for pred, val := range n.edges {
 		if len(n.source) == 0 {
 			return errors.New(fmt.Sprintf(
@@ -154,6 +281,42 @@ func (n *Update) doExecute(c *req.Context, its *[]*x.Instruction) error {
 		*its = append(*its, i)
 	}
 
+	for _, l := range n.links {
+		if len(n.source) == 0 {
+			return errors.New(fmt.Sprintf(
+				"No source specified for id: %v kind: %v", n.id, n.kind))
+		}
+		if len(l.predicate) == 0 || len(l.id) == 0 {
+			return errors.New(fmt.Sprintf(
+				"Invalid edge from id: %v to id: %v", n.id, l.id))
+		}
+
+		// Create edge from current entity to target
+		i := new(x.Instruction)
+		i.SubjectId = n.id
+		i.SubjectType = n.kind
+		i.Predicate = l.predicate
+		i.ObjectId = l.id
+		i.Source = n.source
+		i.NanoTs = n.NanoTs
+		log.WithField("instruction", i).Debug("Pushing to list")
+		*its = append(*its, i)
+
+		if len(l.reverse) == 0 {
+			continue
+		}
+		// Create edge from target back to current entity
+		i = new(x.Instruction)
+		i.SubjectId = l.id
+		i.SubjectType = l.kind
+		i.Predicate = l.reverse
+		i.ObjectId = n.id
+		i.Source = n.source
+		i.NanoTs = n.NanoTs
+		log.WithField("instruction", i).Debug("Pushing to list")
+		*its = append(*its, i)
+	}
+
 	if len(n.children) == 0 {
 		return nil
 	}
@@ -177,17 +340,25 @@ func (n *Update) doExecute(c *req.Context, its *[]*x.Instruction) error {
 	// would automatically filter out that child and it's children
 	// from being retrieved.
 
+	s, err := getCtx(c)
+	if err != nil {
+		return err
+	}
 	for _, child := range n.children {
 		if len(child.id) > 0 {
-			log.WithField("child_id", child.id).Fatal(
+			log.WithField("child_id", child.id).Error(
 				"Child id should be empty for all current use cases")
-			return errors.New("Non empty child id")
+			return ErrNonEmptyChildId
 		}
 
 		for idx := 0; ; idx++ { // Retry loop.
 			child.id = x.UniqueString(c.NumCharsUnique)
 			log.WithField("id", child.id).Debug("Checking availability of new id")
-			if isnew := Get().IsNew(child.id); isnew {
+			isnew, err := s.IsNewCtx(ctx, child.id)
+			if err != nil {
+				return err
+			}
+			if isnew {
 				log.WithField("id", child.id).Debug("New id available")
 				break
 			}
@@ -217,7 +388,7 @@ func (n *Update) doExecute(c *req.Context, its *[]*x.Instruction) error {
 		log.WithField("instruction", i).Debug("Pushing to list")
 		*its = append(*its, i)
 
-		if err := child.doExecute(c, its); err != nil {
+		if err := child.doExecute(ctx, c, its); err != nil {
 			return err
 		}
 	}
@@ -225,26 +396,72 @@ func (n *Update) doExecute(c *req.Context, its *[]*x.Instruction) error {
 }
 
 // Execute finds the root from the given Update pointer, recursively generates
-// the set of instructions to store, and commits them. Returns any errors
-// encountered during these steps.
+// the set of instructions to store, and commits them to the store driver
+// named by c.Store, or the default one. Returns any errors encountered
+// during these steps.
 func (n *Update) Execute(c *req.Context) error {
+	return n.ExecuteCtx(context.Background(), c)
+}
+
+// ExecuteCtx is the same as Execute, but stops reading the store and
+// returns ctx.Err() as soon as ctx is cancelled, or its deadline is exceeded.
+// Once the commit starts, it isn't abandoned; so if an error is returned,
+// nothing has been written.
+func (n *Update) ExecuteCtx(ctx context.Context, c *req.Context) error {
 	if c.NumCharsUnique <= 0 {
-		log.Fatal("Invalid number of chars for generating unique ids. Set req.Context.NumCharsUnique")
-		return errors.New("Invalid req.Context.NumCharsUnique")
+		log.Error("Invalid number of chars for generating unique ids. Set req.Context.NumCharsUnique")
+		return ErrInvalidNumChars
 	}
 
 	n = n.root()
 
 	var its []*x.Instruction
-	err := n.doExecute(c, &its)
+	err := n.doExecute(ctx, c, &its)
 	if err != nil {
 		return err
 	}
+	return commit(ctx, c, []*Update{n}, its)
+}
+
+// commit writes the instructions to the store in a single Commit call,
+// and once that succeeds, sends the modified entities off to indexer.
+// If any of the given update trees are conditional, their versions are
+// checked right before the commit.
+func commit(ctx context.Context, c *req.Context, roots []*Update,
+	its []*x.Instruction) error {
 	if len(its) == 0 {
 		return errors.New("No instructions generated")
 	}
+	s, err := getCtx(c)
+	if err != nil {
+		return err
+	}
 
-	if rerr := Get().Commit(its); rerr != nil {
+	conditional := false
+	for _, root := range roots {
+		if root.isConditional() {
+			conditional = true
+			break
+		}
+	}
+	if conditional {
+		commitMu.Lock()
+		for _, root := range roots {
+			if err := root.checkVersions(ctx, s); err != nil {
+				commitMu.Unlock()
+				return err
+			}
+		}
+	} else {
+		commitMu.RLock()
+	}
+	rerr := s.CommitCtx(ctx, its)
+	if conditional {
+		commitMu.Unlock()
+	} else {
+		commitMu.RUnlock()
+	}
+	if rerr != nil {
 		return rerr
 	}
 
@@ -1,13 +1,15 @@
 package testx
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"testing"
 
-	_ "github.com/manishrjain/gocrud/drivers/leveldb"
+	"github.com/manishrjain/gocrud/drivers/leveldb"
 	"github.com/manishrjain/gocrud/req"
 	"github.com/manishrjain/gocrud/store"
+	"github.com/manishrjain/gocrud/x"
 )
 
 func TestVersions(t *testing.T) {
@@ -69,3 +71,532 @@ func TestVersions(t *testing.T) {
 		t.Errorf("Source expected nasdaq. Got: %+v", jv)
 	}
 }
+
+func TestAsOf(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContext(10)
+	if err = store.NewUpdate("Ticker", "MSFT").SetSource("nasdaq").
+		Set("price", 40).SetCommitTs(100).Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+	u := store.NewUpdate("Ticker", "MSFT").SetSource("nasdaq").Set("price", 45)
+	u.AddChild("News").Set("title", "Earnings")
+	if err = u.SetCommitTs(200).Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+	if err = store.NewUpdate("Ticker", "MSFT").SetSource("nasdaq").
+		MarkDeleted().SetCommitTs(300).Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+
+	result, err := store.NewQuery("MSFT").UptoDepth(1).AsOf(150).Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if v := result.Columns["price"].Latest().Value.(float64); v != 40 {
+		t.Errorf("Price expected 40. Got: %v", v)
+	}
+	if len(result.Children) != 0 {
+		t.Errorf("Expected no children. Got: %v", len(result.Children))
+	}
+
+	result, err = store.NewQuery("MSFT").UptoDepth(1).AsOf(250).Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if v := result.Columns["price"].Latest().Value.(float64); v != 45 {
+		t.Errorf("Price expected 45. Got: %v", v)
+	}
+	if len(result.Children) != 1 {
+		t.Errorf("Expected one child. Got: %v", len(result.Children))
+	}
+
+	result, err = store.NewQuery("MSFT").AsOf(50).Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if len(result.Id) > 0 {
+		t.Errorf("Entity shouldn't exist yet. Got: %+v", result)
+	}
+
+	result, err = store.NewQuery("MSFT").Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if len(result.Id) > 0 {
+		t.Errorf("Entity should be deleted. Got: %+v", result)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContext(10)
+	if err = store.NewUpdate("Post", "pid").SetSource("alice").
+		Set("body", "hello").Set("url", "a.com").SetCommitTs(100).Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+	u := store.NewUpdate("Post", "pid").SetSource("bob").Set("body", "hello world")
+	u.AddChild("Comment").Set("body", "nice")
+	if err = u.SetCommitTs(200).Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+
+	revs, err := store.History("pid")
+	if err != nil {
+		t.Fatalf("While retrieving history: %+v", err)
+	}
+	if len(revs) != 2 {
+		t.Fatalf("Expected 2 revisions. Got: %+v", revs)
+	}
+	if revs[0].Source != "alice" || len(revs[0].Changes) != 2 {
+		t.Errorf("Unexpected first revision: %+v", revs[0])
+	}
+	r := revs[1]
+	if r.Source != "bob" || r.NanoTs != 200 || len(r.Changes) != 2 {
+		t.Fatalf("Unexpected second revision: %+v", r)
+	}
+	// Changes are sorted by predicate, so the child edge comes first.
+	ch := r.Changes[0]
+	if ch.Predicate != "Comment" || !ch.Edge || ch.New.Value == "" ||
+		ch.Old.Value != nil {
+		t.Errorf("Unexpected child edge change: %+v", ch)
+	}
+	ch = r.Changes[1]
+	if ch.Predicate != "body" || ch.Old.Value != "hello" || ch.Edge ||
+		ch.New.Value != "hello world" || ch.Old.Source != "alice" {
+		t.Errorf("Unexpected change: %+v", ch)
+	}
+
+	if err = store.NewUpdate("Post", "pid").SetSource("carol").
+		AddEdge("related", "Post", "other").SetCommitTs(300).Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+	if revs, err = store.History("pid"); err != nil {
+		t.Fatalf("While retrieving history: %+v", err)
+	}
+	if len(revs) != 3 {
+		t.Fatalf("Expected 3 revisions. Got: %+v", revs)
+	}
+	r = revs[2]
+	if r.Source != "carol" || r.NanoTs != 300 || len(r.Changes) != 1 {
+		t.Fatalf("Unexpected third revision: %+v", r)
+	}
+	ch = r.Changes[0]
+	if ch.Predicate != "related" || !ch.Edge || ch.New.Value != "other" ||
+		ch.New.Source != "carol" {
+		t.Errorf("Unexpected edge change: %+v", ch)
+	}
+}
+
+func TestVersionsHistory(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContext(10)
+	for ts := int64(1); ts <= 5; ts++ {
+		if err = store.NewUpdate("Comment", "cid").SetSource("author").
+			Set("body", ts*10).SetCommitTs(ts * 100).Execute(c); err != nil {
+			t.Fatalf("When updating store: %+v", err)
+		}
+	}
+	result, err := store.NewQuery("cid").Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	versions := result.Columns["body"]
+	if all := versions.All(); len(all) != 5 || all[0].NanoTs != 100 {
+		t.Errorf("Unexpected versions: %+v", all)
+	}
+	if o := versions.At(250); o.Value.(float64) != 20 {
+		t.Errorf("Value at 250 expected 20. Got: %+v", o)
+	}
+	if o := versions.At(50); o.Value != nil {
+		t.Errorf("Value at 50 should be empty. Got: %+v", o)
+	}
+	if since := versions.Since(300); len(since) != 2 || since[0].NanoTs != 400 {
+		t.Errorf("Unexpected versions since 300: %+v", since)
+	}
+
+	js, err := result.ToJsonWithVersions()
+	if err != nil {
+		t.Fatalf("While converting to JSON: %v", err)
+	}
+	var jv struct {
+		Body []struct {
+			Value  int    `json:"value"`
+			Source string `json:"source"`
+			Ts     int64  `json:"ts"`
+		} `json:"body"`
+	}
+	if err = json.Unmarshal(js, &jv); err != nil {
+		t.Fatalf("While unmarshal to struct: %v", err)
+	}
+	if len(jv.Body) != 5 || jv.Body[4].Value != 50 ||
+		jv.Body[4].Source != "author" || jv.Body[4].Ts != 500 {
+		t.Errorf("Unexpected JSON: %s", js)
+	}
+
+	// Object itself keeps its field names in JSON.
+	if js, err = json.Marshal(versions.Latest()); err != nil {
+		t.Fatalf("While converting to JSON: %v", err)
+	}
+	if string(js) != `{"Value":50,"Source":"author","NanoTs":500}` {
+		t.Errorf("Unexpected Object JSON: %s", js)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContextWithUpdates(10, 10)
+	b := store.NewBatch()
+	b.Add(store.NewUpdate("User", "alice").SetSource("bank").Set("credits", 90))
+	u := store.NewUpdate("User", "bob").SetSource("bank").Set("credits", 110)
+	b.Add(u).Add(u)
+	if err = b.Execute(c); err != nil {
+		t.Fatalf("While executing batch: %+v", err)
+	}
+	close(c.Updates)
+	var updated int
+	for range c.Updates {
+		updated += 1
+	}
+	if updated != 2 {
+		t.Errorf("Expected 2 entity updates. Got: %v", updated)
+	}
+
+	for id, credits := range map[string]float64{"alice": 90, "bob": 110} {
+		result, err := store.NewQuery(id).Run()
+		if err != nil {
+			t.Fatalf("When querying store: %+v", err)
+		}
+		versions := result.Columns["credits"]
+		if versions.Count() != 1 || versions.Latest().Value.(float64) != credits {
+			t.Errorf("Unexpected credits for %v: %+v", id, versions.All())
+		}
+	}
+}
+
+func TestIfUnchangedSince(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContext(10)
+	if err = store.NewUpdate("User", "carol").SetSource("carol").
+		Set("credits", 10).Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+	version, err := store.Version("carol")
+	if err != nil {
+		t.Fatalf("While retrieving version: %+v", err)
+	}
+
+	// Another writer sneaks in.
+	if err = store.NewUpdate("User", "carol").SetSource("admin").
+		Set("credits", 20).SetCommitTs(version + 1).Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+
+	err = store.NewUpdate("User", "carol").SetSource("carol").
+		Set("credits", 5).IfUnchangedSince(version).Execute(c)
+	if err != store.ErrConflict {
+		t.Errorf("Expected conflict. Got: %v", err)
+	}
+
+	if version, err = store.Version("carol"); err != nil {
+		t.Fatalf("While retrieving version: %+v", err)
+	}
+	if err = store.NewUpdate("User", "carol").SetSource("carol").
+		Set("credits", 15).IfUnchangedSince(version).Execute(c); err != nil {
+		t.Errorf("Expected no conflict. Got: %v", err)
+	}
+}
+
+func TestRunCtx(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContext(10)
+	u := store.NewUpdate("User", "dave").SetSource("dave")
+	u.AddChild("Post").Set("body", "first")
+	if err = u.ExecuteCtx(context.Background(), c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+
+	result, err := store.NewQuery("dave").UptoDepth(1).RunCtx(context.Background())
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if len(result.Children) != 1 {
+		t.Errorf("Expected one child. Got: %+v", result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = store.NewQuery("dave").UptoDepth(1).RunCtx(ctx); err != context.Canceled {
+		t.Errorf("Expected context.Canceled. Got: %v", err)
+	}
+	err = store.NewUpdate("User", "dave").SetSource("dave").Set("a", 1).ExecuteCtx(ctx, c)
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled. Got: %v", err)
+	}
+}
+
+func TestNamedStores(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+
+	apath, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	archive := new(leveldb.Leveldb)
+	archive.Init(apath)
+	if err = store.Register("archive", archive); err != nil {
+		t.Fatalf("While registering: %v", err)
+	}
+	if err = store.Register("archive", archive); err != store.ErrDuplicateDriver {
+		t.Errorf("Expected ErrDuplicateDriver. Got: %v", err)
+	}
+	if store.GetNamed("archive") != archive {
+		t.Error("Expected archive store")
+	}
+
+	c := req.NewContext(10)
+	c.Store = "archive"
+	if err = store.NewUpdate("Post", "old").SetSource("author").
+		Set("body", "archived").Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+
+	result, err := store.NewQuery("old").Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if len(result.Id) > 0 {
+		t.Errorf("Default store shouldn't have the entity. Got: %+v", result)
+	}
+	result, err = store.NewQuery("old").SetContext(c).Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if result.Id != "old" {
+		t.Errorf("Archive store should have the entity. Got: %+v", result)
+	}
+
+	if version, err := store.Version("old"); err != nil || version != 0 {
+		t.Errorf("Expected no version in default store. Got: %v %v", version, err)
+	}
+	if version, err := store.VersionNamed("archive", "old"); err != nil || version == 0 {
+		t.Errorf("Expected a version in archive store. Got: %v %v", version, err)
+	}
+	revs, err := store.HistoryNamed("archive", "old")
+	if err != nil {
+		t.Fatalf("When retrieving history: %+v", err)
+	}
+	if len(revs) != 1 || revs[0].Source != "author" {
+		t.Errorf("Expected a single revision by author. Got: %+v", revs)
+	}
+	if _, err = store.ParentNamed("archive", "old"); err != store.ErrNoParent {
+		t.Errorf("Expected ErrNoParent. Got: %v", err)
+	}
+	if _, err = store.VersionNamed("missing", "old"); err != store.ErrNoDriver {
+		t.Errorf("Expected ErrNoDriver. Got: %v", err)
+	}
+
+	c.Store = "missing"
+	if _, err = store.NewQuery("old").SetContext(c).Run(); err != store.ErrNoDriver {
+		t.Errorf("Expected ErrNoDriver. Got: %v", err)
+	}
+}
+
+func TestAddEdge(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContext(10)
+	for _, uid := range []string{"erin", "frank"} {
+		if err = store.NewUpdate("User", uid).SetSource(uid).
+			Set("name", uid).Execute(c); err != nil {
+			t.Fatalf("When updating store: %+v", err)
+		}
+	}
+	if err = store.NewUpdate("User", "erin").SetSource("erin").
+		AddEdgeWithReverse("follows", "followed_by", "User", "frank").
+		Execute(c); err != nil {
+		t.Fatalf("When adding edge: %+v", err)
+	}
+
+	result, err := store.NewQuery("erin").Collect("follows").Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if len(result.Children) != 1 || result.Children[0].Id != "frank" {
+		t.Fatalf("Expected to follow frank. Got: %+v", result)
+	}
+	if name := result.Children[0].Columns["name"].Latest().Value; name != "frank" {
+		t.Errorf("Expected name frank. Got: %v", name)
+	}
+
+	result, err = store.NewQuery("frank").UptoDepth(1).Run()
+	if err != nil {
+		t.Fatalf("When querying store: %+v", err)
+	}
+	if len(result.Children) != 1 || result.Children[0].Id != "erin" {
+		t.Errorf("Expected reverse edge to erin. Got: %+v", result)
+	}
+}
+
+func TestIncoming(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContext(10)
+	if err = store.NewUpdate("Post", "pst").SetSource("grace").
+		Set("body", "cats").Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+	for _, uid := range []string{"heidi", "ivan", "judy"} {
+		if err = store.NewUpdate("User", uid).SetSource(uid).
+			AddEdge("likes", "Post", "pst").Execute(c); err != nil {
+			t.Fatalf("When adding edge: %+v", err)
+		}
+	}
+	if err = store.NewUpdate("User", "judy").SetSource("judy").
+		MarkDeleted().Execute(c); err != nil {
+		t.Fatalf("When updating store: %+v", err)
+	}
+
+	likers, err := store.NewQuery("pst").Incoming("likes")
+	if err != nil {
+		t.Fatalf("While retrieving incoming: %+v", err)
+	}
+	if len(likers) != 2 {
+		t.Errorf("Expected 2 likers. Got: %+v", likers)
+	}
+	for _, e := range likers {
+		if e.Kind != "User" || (e.Id != "heidi" && e.Id != "ivan") {
+			t.Errorf("Unexpected liker: %+v", e)
+		}
+	}
+
+	likers, err = store.NewQuery("pst").AllowDeleted().Incoming("likes")
+	if err != nil {
+		t.Fatalf("While retrieving incoming: %+v", err)
+	}
+	if len(likers) != 3 {
+		t.Errorf("Expected 3 likers. Got: %+v", likers)
+	}
+	if others, err := store.NewQuery("pst").Incoming("follows"); err != nil || len(others) != 0 {
+		t.Errorf("Expected no entities. Got: %+v, %v", others, err)
+	}
+
+	// Reverse index shouldn't show up during iteration.
+	ch := make(chan x.Entity, 100)
+	num, _, err := store.Get().Iterate("", 100, ch)
+	if err != nil {
+		t.Fatalf("While iterating: %+v", err)
+	}
+	if num != 4 {
+		t.Errorf("Expected 4 entities. Got: %v", num)
+	}
+}
+
+func TestRunMigrations(t *testing.T) {
+	var applied []int
+	migration := func(v int) store.Migration {
+		return store.Migration{Version: v, Apply: func() error {
+			applied = append(applied, v)
+			return nil
+		}}
+	}
+	ms := []store.Migration{migration(1), migration(2), migration(3)}
+
+	var recorded []int
+	record := func(v int) error {
+		recorded = append(recorded, v)
+		return nil
+	}
+
+	version, err := store.RunMigrations(1, ms, record)
+	if err != nil {
+		t.Fatalf("While running migrations: %+v", err)
+	}
+	if version != 3 {
+		t.Errorf("Expected version 3. Got: %v", version)
+	}
+	if len(applied) != 2 || applied[0] != 2 || applied[1] != 3 {
+		t.Errorf("Expected migrations 2 and 3 to be applied. Got: %v", applied)
+	}
+	if len(recorded) != 2 || recorded[1] != 3 {
+		t.Errorf("Expected versions 2 and 3 to be recorded. Got: %v", recorded)
+	}
+
+	// Nothing left to apply.
+	applied = applied[:0]
+	if version, err = store.RunMigrations(3, ms, record); err != nil || version != 3 {
+		t.Errorf("Expected version 3 and no error. Got: %v, %v", version, err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("Expected no migrations to be applied. Got: %v", applied)
+	}
+
+	// Stops at the first failure, and reports the last version reached.
+	failing := store.Migration{Version: 3, Apply: func() error {
+		return store.ErrNotImplemented
+	}}
+	ms = []store.Migration{migration(1), migration(2), failing}
+	if version, err = store.RunMigrations(0, ms, record); err != store.ErrNotImplemented {
+		t.Errorf("Expected ErrNotImplemented. Got: %v", err)
+	}
+	if version != 2 {
+		t.Errorf("Expected version 2. Got: %v", version)
+	}
+
+	ms = []store.Migration{migration(2), migration(1)}
+	if _, err = store.RunMigrations(0, ms, record); err != store.ErrUnsortedMigrations {
+		t.Errorf("Expected ErrUnsortedMigrations. Got: %v", err)
+	}
+}
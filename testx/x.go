@@ -2,10 +2,12 @@ package testx
 
 import (
 	"log"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/manishrjain/gocrud/search"
+	"github.com/manishrjain/gocrud/store"
 	"github.com/manishrjain/gocrud/x"
 )
 
@@ -28,6 +30,14 @@ func AddDocs(e search.Engine) {
 		m := make(map[string]interface{})
 		m["name"] = name
 		m["pos"] = idx
+		// Three docs for every three hours, starting 2015-01-01 UTC.
+		m["creation_ms"] = int64(1420070400000) + int64(idx)*time.Hour.Nanoseconds()/1e6
+		m["label"] = name // To be mapped as a keyword, by engines analyzing strings.
+		m["discovered"] = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC).
+			Add(time.Duration(idx) * time.Hour)
+		if strings.HasPrefix(name, "ngc") {
+			m["catalog"] = "ngc"
+		}
 		d.Data = m
 
 		if err := e.Update(d); err != nil {
@@ -138,3 +148,406 @@ func RunFromLimit(e search.Engine, t *testing.T) {
 	check(docs[0], "galaxy ngc 1512", t)
 	check(docs[1], "ngc 123", t)
 }
+
+func runNames(q search.Query, t *testing.T) []string {
+	docs, err := q.Order("pos").Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return nil
+	}
+	var names []string
+	for _, doc := range docs {
+		m := doc.Data.(map[string]interface{})
+		names = append(names, m["name"].(string))
+	}
+	return names
+}
+
+func checkNames(names []string, expected []string, t *testing.T) {
+	if len(names) != len(expected) {
+		t.Errorf("Expected: %v. Found: %v\n", expected, names)
+		return
+	}
+	for idx, name := range names {
+		if name != expected[idx] {
+			t.Errorf("Expected: %v. Found: %v\n", expected, names)
+			return
+		}
+	}
+}
+
+func RunRangeFilter(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy")
+	q.NewAndFilter().AddRange("pos", 2, 5)
+	checkNames(runNames(q, t), []string{
+		"2masx", "whirlpool galaxy", "ngc 123", "supernova"}, t)
+
+	q = e.NewQuery("Galaxy")
+	q.NewAndFilter().AddRange("pos", 7, nil)
+	checkNames(runNames(q, t), []string{"ngc 3370", "m81"}, t)
+
+	q = e.NewQuery("Galaxy")
+	q.NewAndFilter().AddRange("pos", nil, 1).AddRegex("name", ".*galaxy.*")
+	checkNames(runNames(q, t), []string{"sombrero galaxy"}, t)
+}
+
+func RunPrefixFilter(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy")
+	q.NewOrFilter().AddPrefix("name", "whirl").AddPrefix("name", "somb")
+	checkNames(runNames(q, t), []string{
+		"sombrero galaxy", "whirlpool galaxy"}, t)
+}
+
+func RunMatchFilter(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy")
+	q.NewAndFilter().AddMatch("name", "Galaxy")
+	checkNames(runNames(q, t), []string{
+		"sombrero galaxy", "whirlpool galaxy", "galaxy ngc 1512"}, t)
+
+	// Docs with any of the terms match.
+	q = e.NewQuery("Galaxy")
+	q.NewAndFilter().AddMatch("name", "Galaxies NGC")
+	checkNames(runNames(q, t), []string{
+		"ngc 123", "galaxy ngc 1512", "ngc 3370"}, t)
+}
+
+func RunExistsFilter(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy")
+	q.NewAndFilter().AddExists("catalog")
+	checkNames(runNames(q, t), []string{"ngc 123", "ngc 3370"}, t)
+
+	q = e.NewQuery("Galaxy")
+	q.NewAndFilter().AddMissing("catalog").AddRange("pos", 3, 7)
+	checkNames(runNames(q, t), []string{
+		"whirlpool galaxy", "supernova", "galaxy ngc 1512"}, t)
+}
+
+func RunNestedFilter(e search.Engine, t *testing.T) {
+	// (name ~ galaxy OR has catalog) AND NOT pos >= 6
+	q := e.NewQuery("Galaxy")
+	f := q.NewAndFilter()
+	f.Or().AddRegex("name", ".*galaxy.*").AddExists("catalog")
+	f.Not().AddRange("pos", 6, nil)
+	f.And() // Empty clauses are ignored.
+	checkNames(runNames(q, t), []string{
+		"sombrero galaxy", "whirlpool galaxy", "ngc 123"}, t)
+
+	// Not negates all of its filters together.
+	q = e.NewQuery("Galaxy")
+	q.NewOrFilter().Not().AddExists("catalog").AddRange("pos", nil, 4)
+	checkNames(runNames(q, t), []string{
+		"sombrero galaxy", "messier 64", "2masx", "whirlpool galaxy",
+		"supernova", "galaxy ngc 1512", "ngc 3370", "m81"}, t)
+}
+
+func RunAggregate(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy")
+	results, err := q.Aggregate(
+		search.Terms("catalogs", "catalog", 10),
+		search.Stats("pos_stats", "pos"),
+		search.DateHistogram("created", "creation_ms", 3*time.Hour))
+	if err != nil {
+		t.Fatalf("While aggregating: %v", err)
+		return
+	}
+
+	terms := results["catalogs"].Buckets
+	if len(terms) != 1 || terms[0].Key != "ngc" || terms[0].Count != 2 {
+		t.Errorf("Expected 2 docs in ngc catalog. Found: %+v", terms)
+	}
+
+	stats := results["pos_stats"]
+	if stats.Count != 9 || stats.Min != 0 || stats.Max != 8 ||
+		stats.Sum != 36 || stats.Avg != 4 {
+		t.Errorf("Unexpected stats for pos: %+v", stats)
+	}
+
+	hist := results["created"].Buckets
+	if len(hist) != 3 {
+		t.Fatalf("Expected 3 buckets. Found: %+v", hist)
+		return
+	}
+	for idx, b := range hist {
+		key := int64(1420070400000) + int64(idx)*3*time.Hour.Nanoseconds()/1e6
+		if b.Key != key || b.Count != 3 {
+			t.Errorf("Expected 3 docs at %v. Found: %+v", key, b)
+		}
+	}
+
+	// Aggregations only consider the docs matching the filter.
+	q = e.NewQuery("Galaxy")
+	q.NewAndFilter().AddRegex("name", ".*galaxy.*")
+	results, err = q.Aggregate(search.Stats("pos_stats", "pos"))
+	if err != nil {
+		t.Fatalf("While aggregating: %v", err)
+		return
+	}
+	stats = results["pos_stats"]
+	if stats.Count != 3 || stats.Min != 0 || stats.Max != 6 || stats.Avg != 3 {
+		t.Errorf("Unexpected stats for pos: %+v", stats)
+	}
+}
+
+func RunMultiOrder(e search.Engine, t *testing.T) {
+	names := func(q search.Query) []string {
+		docs, err := q.Run()
+		if err != nil {
+			t.Fatalf("While running query: %v", err)
+			return nil
+		}
+		var names []string
+		for _, doc := range docs {
+			m := doc.Data.(map[string]interface{})
+			names = append(names, m["name"].(string))
+		}
+		return names
+	}
+
+	// Docs missing the catalog are placed last, irrespective of direction.
+	checkNames(names(e.NewQuery("Galaxy").Order("catalog", "-pos")), []string{
+		"ngc 3370", "ngc 123", "m81", "galaxy ngc 1512", "supernova",
+		"whirlpool galaxy", "2masx", "messier 64", "sombrero galaxy"}, t)
+	checkNames(names(e.NewQuery("Galaxy").Order("-catalog", "pos")), []string{
+		"ngc 123", "ngc 3370", "sombrero galaxy", "messier 64", "2masx",
+		"whirlpool galaxy", "supernova", "galaxy ngc 1512", "m81"}, t)
+
+	// Calling Order again replaces the earlier fields.
+	checkNames(names(e.NewQuery("Galaxy").Order("catalog").Order("pos").Limit(3)),
+		[]string{"sombrero galaxy", "messier 64", "2masx"}, t)
+}
+
+// pageNames runs the query via cursors, a page at a time, until there're
+// no more docs. Returns the names found on each page.
+func pageNames(newQuery func() search.Query, t *testing.T) [][]string {
+	var pages [][]string
+	var cursor string
+	for i := 0; i < 10; i++ {
+		q := newQuery()
+		if len(cursor) > 0 {
+			q.After(cursor)
+		}
+		docs, next, err := q.RunWithCursor()
+		if err != nil {
+			t.Fatalf("While running query: %v", err)
+			return nil
+		}
+		if len(docs) == 0 {
+			if len(next) > 0 {
+				t.Errorf("Expected empty cursor. Found: %v", next)
+			}
+			return pages
+		}
+		var names []string
+		for _, doc := range docs {
+			m := doc.Data.(map[string]interface{})
+			names = append(names, m["name"].(string))
+		}
+		pages = append(pages, names)
+		cursor = next
+	}
+	t.Fatalf("Cursor didn't reach the end: %v", pages)
+	return nil
+}
+
+func RunCursor(e search.Engine, t *testing.T) {
+	pages := pageNames(func() search.Query {
+		return e.NewQuery("Galaxy").Order("-pos").Limit(4)
+	}, t)
+	if len(pages) != 3 {
+		t.Fatalf("Expected 3 pages. Found: %v", pages)
+		return
+	}
+	checkNames(pages[0], []string{
+		"m81", "ngc 3370", "galaxy ngc 1512", "supernova"}, t)
+	checkNames(pages[1], []string{
+		"ngc 123", "whirlpool galaxy", "2masx", "messier 64"}, t)
+	checkNames(pages[2], []string{"sombrero galaxy"}, t)
+
+	// Time values should survive the round trip via cursors.
+	pages = pageNames(func() search.Query {
+		return e.NewQuery("Galaxy").Order("discovered").Limit(4)
+	}, t)
+	if len(pages) != 3 {
+		t.Fatalf("Expected 3 pages. Found: %v", pages)
+		return
+	}
+	checkNames(pages[0], []string{
+		"sombrero galaxy", "messier 64", "2masx", "whirlpool galaxy"}, t)
+	checkNames(pages[2], []string{"m81"}, t)
+
+	// Paging over multi-word strings shouldn't skip, or repeat any docs.
+	pages = pageNames(func() search.Query {
+		return e.NewQuery("Galaxy").Order("label").Limit(2)
+	}, t)
+	seen := make(map[string]bool)
+	for _, page := range pages {
+		for _, name := range page {
+			seen[name] = true
+		}
+	}
+	if len(pages) != 5 || len(seen) != len(galaxies) {
+		t.Errorf("Expected all %v docs once. Found: %v", len(galaxies), pages)
+	}
+
+	// Cursors also work across docs missing some of the order fields.
+	pages = pageNames(func() search.Query {
+		return e.NewQuery("Galaxy").Order("catalog", "-pos").Limit(4)
+	}, t)
+	if len(pages) != 3 {
+		t.Fatalf("Expected 3 pages. Found: %v", pages)
+		return
+	}
+	checkNames(pages[0], []string{
+		"ngc 3370", "ngc 123", "m81", "galaxy ngc 1512"}, t)
+	checkNames(pages[1], []string{
+		"supernova", "whirlpool galaxy", "2masx", "messier 64"}, t)
+	checkNames(pages[2], []string{"sombrero galaxy"}, t)
+
+	// Docs with the same catalog are ordered by their ids.
+	pages = pageNames(func() search.Query {
+		q := e.NewQuery("Galaxy").Order("catalog").Limit(1)
+		q.NewAndFilter().AddExact("catalog", "ngc")
+		return q
+	}, t)
+	if len(pages) != 2 || pages[0][0] == pages[1][0] {
+		t.Errorf("Expected 2 distinct pages. Found: %v", pages)
+	}
+
+	// Without an order, docs are returned in the order of their ids.
+	var ids []string
+	var cursor string
+	for {
+		q := e.NewQuery("Galaxy").Limit(4)
+		if len(cursor) > 0 {
+			q.After(cursor)
+		}
+		docs, next, err := q.RunWithCursor()
+		if err != nil {
+			t.Fatalf("While running query: %v", err)
+			return
+		}
+		if len(docs) == 0 {
+			break
+		}
+		for _, doc := range docs {
+			ids = append(ids, doc.Id)
+		}
+		cursor = next
+	}
+	if len(ids) != len(galaxies) {
+		t.Errorf("Expected %v docs. Found: %v", len(galaxies), ids)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i-1] >= ids[i] {
+			t.Errorf("Ids should be in increasing order. Found: %v", ids)
+			break
+		}
+	}
+
+	if _, err := e.NewQuery("Galaxy").After("invalid!").Run(); err == nil {
+		t.Error("Expected error for invalid cursor")
+	}
+}
+
+func RunDelete(e search.Engine, t *testing.T) {
+	count := func() int64 {
+		c, err := e.NewQuery("Comet").Count()
+		if err != nil {
+			t.Fatalf("While counting: %v", err)
+		}
+		return c
+	}
+
+	doc := x.Doc{Kind: "Comet", Id: x.UniqueString(5), NanoTs: 10,
+		Data: map[string]interface{}{"name": "halley"}}
+	if err := e.Update(doc); err != nil {
+		t.Fatalf("While updating: %v", err)
+		return
+	}
+	if err := e.Delete(doc.Kind, doc.Id, 5); err == nil {
+		t.Error("Expected error while deleting with an older version")
+	}
+	if c := count(); c != 1 {
+		t.Errorf("Expected 1 doc. Found: %v", c)
+	}
+
+	if err := e.Delete(doc.Kind, doc.Id, 20); err != nil {
+		t.Errorf("While deleting: %v", err)
+	}
+	if c := count(); c != 0 {
+		t.Errorf("Expected no docs after deletion. Found: %v", c)
+	}
+
+	// Versions older than the deletion shouldn't bring the doc back.
+	doc.NanoTs = 15
+	if err := e.Update(doc); err == nil {
+		t.Error("Expected error while updating with an older version")
+	}
+	if c := count(); c != 0 {
+		t.Errorf("Expected no docs. Found: %v", c)
+	}
+	doc.NanoTs = 30
+	if err := e.Update(doc); err != nil {
+		t.Errorf("While updating: %v", err)
+	}
+	if c := count(); c != 1 {
+		t.Errorf("Expected 1 doc. Found: %v", c)
+	}
+
+	// Deleting a missing doc isn't an error.
+	if err := e.Delete(doc.Kind, x.UniqueString(5), 10); err != nil {
+		t.Errorf("While deleting missing doc: %v", err)
+	}
+}
+
+// RunIterate commits a few entities with multiple instructions each, to an
+// empty store, and pages over them via Iterate, expecting each of them
+// exactly once, in the order of their ids.
+func RunIterate(s store.Store, t *testing.T) {
+	var its []*x.Instruction
+	for _, id := range []string{"d", "b", "e", "a", "c"} {
+		for i := 0; i < 3; i++ {
+			its = append(its, &x.Instruction{
+				SubjectId:   id,
+				SubjectType: "Post",
+				Predicate:   "body",
+				NanoTs:      int64(i),
+			})
+		}
+	}
+	if err := s.Commit(its); err != nil {
+		t.Fatalf("While committing: %+v", err)
+	}
+
+	ch := make(chan x.Entity, 10)
+	var ids []string
+	from := ""
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatalf("Iterate doesn't come to an end. Got: %v", ids)
+		}
+		found, last, err := s.Iterate(from, 2, ch)
+		if err != nil {
+			t.Fatalf("While iterating: %+v", err)
+		}
+		if found == 0 {
+			break
+		}
+		for i := 0; i < found; i++ {
+			e := <-ch
+			if e.Kind != "Post" {
+				t.Errorf("Expected kind Post. Got: %+v", e)
+			}
+			ids = append(ids, e.Id)
+		}
+		from = last.Id
+	}
+	if len(ids) != 5 {
+		t.Fatalf("Expected 5 entities. Got: %v", ids)
+	}
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		if ids[i] != id {
+			t.Errorf("Expected %v at %d. Got: %v", id, i, ids[i])
+		}
+	}
+}
@@ -84,6 +84,11 @@ func (si SimpleIndexer) Regenerate(e x.Entity) (rdoc x.Doc) {
 		x.LogErr(log, err).Fatal("While querying store")
 		return
 	}
+	if len(result.Id) == 0 {
+		// Deleted entities aren't returned by the store.
+		rdoc.Deleted = true
+		return
+	}
 	data := result.ToMap()
 	rdoc.Data = data
 	return
@@ -34,12 +34,14 @@ type Entity struct {
 	Id   string
 }
 
-// Doc is the format data gets stored in search engine.
+// Doc is the format data gets stored in search engine. Deleted marks
+// the doc as a tombstone, for the entities which have been deleted.
 type Doc struct {
-	Kind   string
-	Id     string
-	NanoTs int64
-	Data   interface{}
+	Kind    string
+	Id      string
+	NanoTs  int64
+	Data    interface{}
+	Deleted bool `json:",omitempty"`
 }
 
 // Instruction is the format data gets stored in the underlying data stores.